@@ -2,8 +2,9 @@ package client
 
 // CS 161 Project 2
 
-// You MUST NOT change these default imports. ANY additional imports
-// may break the autograder!
+// You MUST NOT change these default imports. Additional imports are
+// limited to the standard library packages listed below, each with what
+// it's for. Anything outside the standard library may break the autograder!
 
 import (
 	"encoding/json"
@@ -14,6 +15,7 @@ import (
 	// hex.EncodeToString(...) is useful for converting []byte to string
 
 	// Useful for string manipulation
+	"strings"
 
 	// Useful for formatting strings (e.g. `fmt.Sprintf`).
 
@@ -21,7 +23,20 @@ import (
 	"errors"
 
 	// Optional.
-	_ "strconv"
+	"strconv"
+
+	// Timestamps recorded in file metadata
+	"time"
+
+	// Streaming file handles
+	"io"
+
+	// Optional compression of content chunks
+	"bytes"
+	"compress/flate"
+
+	// Search results are sorted by name
+	"sort"
 )
 
 // Type definition for the User struct.
@@ -31,18 +46,222 @@ type User struct {
 	PKEDecKey userlib.PKEDecKey
 	encKey    []byte
 	macKey    []byte
+	usageKey  []byte // Key to read the usage record, given to everyone who can write the user's files
+	dedupKey  []byte // Convergent key for chunks of the user's own deduplicated files, never shared
 }
 
-// Files will be stored as a linked list
+// Files will be stored as a linked list. Contents are encrypted under their own key so
+// copies can share them, and the hash lets a file notice changes made by anyone else
+// holding that key
 type ContentNode struct {
 	Contents uuid.UUID
 	NextNode uuid.UUID
+	Size     int
+	Key      []byte
+	Hash     []byte
+
+	// How the stored contents were compressed, empty if they weren't
+	Compression string
 }
 
-// Simplifies file appending, can hop straight to last node
+// Simplifies file appending, can hop straight to last node. Also holds the
+// file's metadata so Stat never has to touch content
 type FileHead struct {
-	FirstNode uuid.UUID
-	LastNode  uuid.UUID
+	FirstNode   uuid.UUID
+	LastNode    uuid.UUID
+	Size        int
+	NumNodes    int
+	Created     time.Time
+	Modified    time.Time
+	LastWriter  string
+	IndexPages  []uuid.UUID
+	PageOffsets []int
+
+	// Chain and index replaced by the last compaction, kept for readers still walking it and
+	// charged until it's deleted
+	RetiredNode  uuid.UUID
+	RetiredPages []uuid.UUID
+	RetiredSize  int
+	RetiredNodes int
+
+	// Past heads kept by StoreFile, oldest first, and how many of them to keep
+	Version     int
+	Versions    []uuid.UUID
+	MaxVersions int
+
+	// Compression applied to chunks written from now on, and whether to pad them
+	Compression   string
+	PadCompressed bool
+
+	// Content-defined chunks, under the owner's convergent key when the owner writes them
+	Dedup bool
+
+	// Extended attributes, readable by everyone the file is shared with
+	Attrs map[string]string
+
+	// Owner's usage record, charged for every content node in the file and its versions
+	Owner        string
+	UsageKey     []byte
+	VersionBytes int
+	VersionNodes int
+
+	// Set on the published head while a batch commits: its record, the hash of the token the
+	// record holds once committed, and the head to publish then. A staged head also names the
+	// last published content node to link to its appended chain
+	Batch     uuid.UUID
+	BatchHash []byte
+	Staged    uuid.UUID
+	LinkNode  uuid.UUID
+	LinkTo    uuid.UUID
+}
+
+// Index pages map file offsets to content nodes so ReadAt can skip straight to them.
+// Appends only ever touch the last page
+type IndexPage struct {
+	Nodes   []uuid.UUID
+	Offsets []int
+}
+
+// Number of content nodes recorded in each index page
+const indexPageSize = 128
+
+// Content is split into content nodes of at most this many bytes, which also
+// bounds the size of any datastore entry holding file content
+var ChunkSize = 64 * 1024
+
+// How long deleted files stay in the trash before they're purged
+var TrashRetention = 30 * 24 * time.Hour
+
+// Compression settings accepted by SetCompression
+const (
+	CompressNone    = ""
+	CompressDeflate = "deflate"
+)
+
+// Conventional attribute names. Labels are comma-separated
+const (
+	AttrContentType = "content-type"
+	AttrLabels      = "labels"
+)
+
+// Bytes and content nodes each user may have across the files they own, 0 for no limit
+var StorageQuota = 0
+var ObjectQuota = 0
+
+// Returned by writes that would put a file's owner over quota
+var ErrQuotaExceeded = errors.New("storage quota exceeded")
+
+// Returned by writes to a file shared read-only
+var ErrReadOnly = errors.New("file is shared read-only")
+
+// Returned by anything but appends to a file shared append-only
+var ErrAppendOnly = errors.New("file is shared append-only")
+
+// Returned by RevokeAccess for recipients who aren't in the file's tree, such as those
+// who declined their invitation
+var errNotShared = errors.New("recipient was not shared with")
+
+// Returned by lookupFile only when nothing is stored under the name, so callers can create
+// it. Any other error means something is there that can't be read
+var errNotFound = errors.New("file does not exist")
+
+// Access CreateInvitationWithAccess can grant. Readers of a file shared read-only can check
+// its data but can't change it
+const (
+	AccessWrite  = "write"
+	AccessRead   = "read"
+	AccessAppend = "append"
+)
+
+// Whether newly created files deduplicate their chunks
+var DefaultDedup = false
+
+// Number of past versions StoreFile keeps for newly created files
+var DefaultMaxVersions = 10
+
+// AppendToFile compacts a file once it has more than this many content nodes.
+// Zero disables automatic compaction
+var CompactThreshold = 0
+
+// The settings above are read on every call, so bad values are rejected there rather than
+// left to panic or misbehave partway through a write
+func checkSettings() (err error) {
+	switch {
+	case ChunkSize <= 0:
+		return errors.New("chunk size must be positive")
+	case CompactThreshold < 0:
+		return errors.New("compact threshold cannot be negative")
+	case DefaultMaxVersions < 0:
+		return errors.New("default version limit cannot be negative")
+	case TrashRetention < 0:
+		return errors.New("trash retention cannot be negative")
+	case StorageQuota < 0 || ObjectQuota < 0:
+		return errors.New("quotas cannot be negative")
+	}
+	return nil
+}
+
+// Reader that decrypts one content node at a time as it is consumed
+type fileReader struct {
+	fileKey    []byte
+	fileMacKey []byte
+	nextNode   uuid.UUID
+	buffer     []byte
+	closed     bool
+}
+
+// Writer that turns every full chunk of written data into a new content node
+type fileWriter struct {
+	user     *User
+	filename string
+	buffer   []byte
+	truncate bool // Next chunk replaces the file's content instead of appending
+	closed   bool
+}
+
+// Changes to several files staged to be published all at once by Commit
+type Batch struct {
+	user      *User
+	files     []*stagedFile
+	committed bool
+	id        uuid.UUID // Record whose token marks the commit point
+	token     []byte
+	pending   PendingBatch
+}
+
+// A file's head as it was when first staged, and the head Commit will publish. Appending to a
+// published chain leaves its last node alone until then, writing the new nodes to an unlinked
+// chain and the index to a copy of the last page
+type stagedFile struct {
+	filename   string
+	fileNodeId uuid.UUID // Node every name for the file resolves to, nil for new files
+	fileKey    []byte
+	fileMacKey []byte
+	writeKey   []byte
+	fileHeadId uuid.UUID
+	before     FileHead
+	head       FileHead
+	created    bool      // New file, only given a node and listed when the batch commits
+	fresh      bool      // Head's last node and index page were written by this batch
+	linkNode   uuid.UUID // Published last node to link to the appended chain
+	linkTo     uuid.UUID
+	oldPages   []uuid.UUID // Index pages copied by the batch, deleted after it commits
+	chains     []uuid.UUID // First nodes of chains written by the batch, deleted if it aborts
+	stagedId   uuid.UUID   // Head to publish, stored when the batch commits
+}
+
+// New files a committing batch lists once it commits, kept until they're all listed so the
+// user's next lookup can finish a batch that stopped partway through
+type PendingBatch struct {
+	Batch     uuid.UUID
+	BatchHash []byte
+	Files     []PendingFile
+}
+
+type PendingFile struct {
+	Filename string
+	Key      []byte
+	Head     uuid.UUID
 }
 
 // Sharing permissions will be stored as a tree
@@ -52,6 +271,89 @@ type FileNode struct {
 	FileHead      uuid.UUID
 	Children      []uuid.UUID
 	ChildrenNames []string
+	IsDir         bool      // Shared folder, FileHead points to its root listing
+	Parent        uuid.UUID // Sharer's node, nil for the owner
+
+	// Invitations from this node that haven't been accepted yet, by recipient
+	Pending map[string]uuid.UUID `json:",omitempty"`
+}
+
+// Which FileNodes of a signed file were given its write key, and where its head is. Stored
+// with the writer key, since anyone who can read the file can rewrite its nodes
+type FileWriters struct {
+	Head  uuid.UUID
+	Nodes []uuid.UUID
+}
+
+// Directories are stored as encrypted listings of their entries
+type Directory struct {
+	Entries  []DirEntry
+	Shared   bool
+	UsageKey []byte `json:",omitempty"` // Shared folder owner's, for files members create
+}
+
+// Entries in a shared folder also hold the node and key needed to reach them
+type DirEntry struct {
+	Name  string
+	IsDir bool
+	Node  uuid.UUID `json:",omitempty"`
+	Key   []byte    `json:",omitempty"`
+}
+
+// Metadata returned by Stat
+type FileInfo struct {
+	Size       int
+	NumNodes   int
+	Owner      string
+	Created    time.Time
+	Modified   time.Time
+	LastWriter string
+}
+
+// Each user's deleted files, encrypted under their own keys
+type Trash struct {
+	Entries []TrashEntry
+}
+
+// Files deleted from a shared folder also hold the node and key needed to restore them
+type TrashEntry struct {
+	Id      uuid.UUID
+	Name    string
+	Deleted time.Time
+	Node    uuid.UUID `json:",omitempty"`
+	Key     []byte    `json:",omitempty"`
+}
+
+// Each user's searchable list of their files and labels, encrypted under their own keys and
+// only ever matched against queries client-side
+type SearchIndex struct {
+	Entries []SearchEntry
+}
+
+type SearchEntry struct {
+	Name   string
+	Labels []string
+}
+
+// Kinds of search query
+const (
+	SearchPrefix    = "prefix"
+	SearchSubstring = "substring"
+	SearchTag       = "tag"
+)
+
+// Content a user is charged for, returned by Usage
+type Usage struct {
+	Bytes   int
+	Objects int
+}
+
+// Past version of a file returned by ListVersions
+type VersionInfo struct {
+	Version    int
+	Size       int
+	Modified   time.Time
+	LastWriter string
 }
 
 // Simple struct to hold all info needed for an invitation
@@ -59,6 +361,55 @@ type Invitation struct {
 	Owner      string
 	ParentNode uuid.UUID
 	FileKey    []byte
+	WriteKey   []byte    `json:",omitempty"` // Signed files only, left out for readers
+	DropKey    []byte    `json:",omitempty"` // Append-only shares get this instead of any file key
+	Expires    time.Time // Must be accepted before then, zero for never
+}
+
+// Pointer to an invitation left in the recipient's inbox, encrypted to them and signed by
+// the sender. Filename is only the sender's suggestion
+type InboxEntry struct {
+	Sender     string
+	Invitation uuid.UUID
+	Filename   string
+	Sent       time.Time
+	Expires    time.Time
+}
+
+// A user's place in a file's share tree, with the users they invited as children. Access
+// is empty for pending invitations to the file's tree, which only their recipient can read
+type ShareNode struct {
+	Username string
+	Access   string
+	Pending  bool
+	Children []ShareNode
+}
+
+// Access an owner gave that ends at a set time. Kept under the owner's own keys, since
+// only the owner's client revokes it
+type Grant struct {
+	Recipient string
+	Expires   time.Time
+}
+
+// Append-only share of a file. Its recipient writes contributions, encrypted to the owner
+// and signed by themselves, at UUIDs only the drop key finds. The owner keeps one of these
+// per recipient and the recipient their own copy, each counting the contributions they've
+// read or written
+type DropBox struct {
+	Owner     string
+	Recipient string
+	Key       []byte
+	Next      int
+
+	// Owner's copy only, the invitation the drop box was given out with
+	Invitation uuid.UUID
+}
+
+// One appended chunk, numbered so the owner can tell it's where it was written
+type Contribution struct {
+	Index   int
+	Content []byte
 }
 
 // UUID's are made with common scheme, i.e. "structs" + username
@@ -119,7 +470,9 @@ func symVerifyThenDec(encKey []byte, macKey []byte, id uuid.UUID) (content []byt
 	return content, nil
 }
 
-// Helper function to encrypt content, tag, then store in datastore with asymmetric scheme
+// Helper function to encrypt content, tag, then store in datastore with asymmetric scheme.
+// Content is encrypted under a fresh symmetric key and only that key goes through PKE, so
+// it can be longer than RSA alone allows
 func asymEncThenTag(username string, signKey userlib.DSSignKey, content interface{}, id uuid.UUID) (err error) {
 	keyId := getUUID("pke", username)
 	encKey, ok := userlib.KeystoreGet(keyId.String())
@@ -132,10 +485,12 @@ func asymEncThenTag(username string, signKey userlib.DSSignKey, content interfac
 		return err
 	}
 
-	encContent, err := userlib.PKEEnc(encKey, marshalContent)
+	symKey := userlib.RandomBytes(16)
+	encSymKey, err := userlib.PKEEnc(encKey, symKey)
 	if err != nil {
 		return err
 	}
+	encContent := append(encSymKey, userlib.SymEnc(symKey, userlib.RandomBytes(16), marshalContent)...)
 
 	tag, err := userlib.DSSign(signKey, encContent)
 	if err != nil {
@@ -161,7 +516,7 @@ func asymVerifyThenDec(username string, decKey userlib.PKEDecKey, id uuid.UUID)
 		return content, errors.New("datastore entry at Id does not exist")
 	}
 
-	if len(dataStoreEntry) < 256 {
+	if len(dataStoreEntry) < 512 {
 		return content, errors.New("tampering has occurred")
 	}
 
@@ -173,16 +528,244 @@ func asymVerifyThenDec(username string, decKey userlib.PKEDecKey, id uuid.UUID)
 		return content, err
 	}
 
-	content, err = userlib.PKEDec(decKey, encMarshalContent)
+	return pkeDecContent(decKey, encMarshalContent)
+}
+
+// Decrypt what asymEncThenTag signed. Entries stored before content went under a symmetric
+// key are a single PKE block of the content itself, and every later entry is longer
+func pkeDecContent(decKey userlib.PKEDecKey, encContent []byte) (content []byte, err error) {
+	if len(encContent) == 256 {
+		return userlib.PKEDec(decKey, encContent)
+	}
+	if len(encContent) < 256+userlib.AESBlockSizeBytes {
+		return content, errors.New("tampering has occurred")
+	}
+	symKey, err := userlib.PKEDec(decKey, encContent[:256])
 	if err != nil {
 		return content, err
 	}
+	if len(symKey) != 16 {
+		return content, errors.New("tampering has occurred")
+	}
+	return userlib.SymDec(symKey, encContent[256:]), nil
+}
+
+// Decrypt an entry stored by asymEncThenTag without checking its signature, for entries that
+// name their own signer. Nothing read this way can be trusted until asymVerifyThenDec has
+// checked it against that signer
+func asymDec(decKey userlib.PKEDecKey, id uuid.UUID) (content []byte, err error) {
+	dataStoreEntry, ok := userlib.DatastoreGet(id)
+	if !ok {
+		return content, errors.New("datastore entry at Id does not exist")
+	}
+	if len(dataStoreEntry) < 512 {
+		return content, errors.New("tampering has occurred")
+	}
+	return pkeDecContent(decKey, dataStoreEntry[256:])
+}
+
+// Keystore name of the key that verifies a signed file's data. It's derived from the file
+// key, so everyone who can read the file can find it, and anyone who ever held the key could
+// claim it. The owner signs the key they register under it, see checkWriterBinding
+func writerKeyName(fileKey []byte) string {
+	return "writer:" + getUUID("writer", string(fileKey)).String()
+}
+
+// What a file's owner signs to register its writer key
+func writerBinding(fileKey []byte, verifyKey userlib.DSVerifyKey) (binding []byte, err error) {
+	marshalKey, err := json.Marshal(verifyKey)
+	if err != nil {
+		return binding, err
+	}
+	return append([]byte(writerKeyName(fileKey)), marshalKey...), nil
+}
+
+// Check a signed file's writer key was registered by its owner, and not by someone else who
+// held the file key and got to the name first. Files that aren't signed pass
+func checkWriterBinding(fileKey []byte, fileMacKey []byte, ownerName string) (err error) {
+	verifyKey, signed := writerVerifyKey(fileKey)
+	if !signed {
+		return nil
+	}
+	ownerKey, ok := userlib.KeystoreGet(getUUID("ds", ownerName).String())
+	if !ok {
+		return errors.New("could not find owner's DSVerifyKey in keystore")
+	}
+
+	// Verify then decrypt the owner's signature
+	sigEntry, err := symVerifyThenDec(fileKey, fileMacKey, getUUID("writer-binding", string(fileKey)))
+	if err != nil {
+		return err
+	}
+	var sig []byte
+	err = json.Unmarshal(sigEntry, &sig)
+	if err != nil {
+		return err
+	}
+	binding, err := writerBinding(fileKey, verifyKey)
+	if err != nil {
+		return err
+	}
+	err = userlib.DSVerify(ownerKey, binding, sig)
+	if err != nil {
+		return errors.New("writer key was not registered by the file's owner")
+	}
+	return nil
+}
+
+// Verify key of a file whose data is signed, ok is false for files that are only tagged
+func writerVerifyKey(fileKey []byte) (verifyKey userlib.DSVerifyKey, ok bool) {
+	return userlib.KeystoreGet(writerKeyName(fileKey))
+}
+
+// Whether the holder of a file's write key, nil if they have none, may change its data
+func checkWritable(fileKey []byte, writeKey []byte) (err error) {
+	if _, signed := writerVerifyKey(fileKey); signed && writeKey == nil {
+		return ErrReadOnly
+	}
+	return nil
+}
+
+// Start signing a file's data under a new file key, before the key is given to anyone, and
+// sign the binding as its owner. The sign key is stored under a random write key that only
+// writers are given
+func setupSigning(user *User, fileKey []byte) (writeKey []byte, err error) {
+	signKey, verifyKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return writeKey, err
+	}
+	err = userlib.KeystoreSet(writerKeyName(fileKey), verifyKey)
+	if err != nil {
+		return writeKey, err
+	}
+	binding, err := writerBinding(fileKey, verifyKey)
+	if err != nil {
+		return writeKey, err
+	}
+	sig, err := userlib.DSSign(user.DSSignKey, binding)
+	if err != nil {
+		return writeKey, err
+	}
+	fileMacKey, err := userlib.HashKDF(fileKey, []byte("mac-key"))
+	if err != nil {
+		return writeKey, err
+	}
+	err = symEncThenTag(fileKey, fileMacKey, sig, getUUID("writer-binding", string(fileKey)))
+	if err != nil {
+		return writeKey, err
+	}
+
+	writeKey = userlib.RandomBytes(16)
+	writeMacKey, err := userlib.HashKDF(writeKey, []byte("mac-key"))
+	if err != nil {
+		return writeKey, err
+	}
+	err = symEncThenTag(writeKey, writeMacKey, signKey, getUUID("writer", string(fileKey)))
+	if err != nil {
+		return writeKey, err
+	}
+	return writeKey, nil
+}
+
+func getSignKey(fileKey []byte, writeKey []byte) (signKey userlib.DSSignKey, err error) {
+	writeMacKey, err := userlib.HashKDF(writeKey, []byte("mac-key"))
+	if err != nil {
+		return signKey, err
+	}
+
+	// Verify then decrypt sign key
+	signKeyEntry, err := symVerifyThenDec(writeKey, writeMacKey, getUUID("writer", string(fileKey)))
+	if err != nil {
+		return signKey, err
+	}
+	err = json.Unmarshal(signKeyEntry, &signKey)
+	if err != nil {
+		return signKey, err
+	}
+	return signKey, nil
+}
+
+func getWriters(fileKey []byte, fileMacKey []byte) (writers FileWriters, err error) {
+	// Verify then decrypt writer record
+	writersEntry, err := fileVerifyThenDec(fileKey, fileMacKey, getUUID("writers", string(fileKey)))
+	if err != nil {
+		return writers, err
+	}
+	err = json.Unmarshal(writersEntry, &writers)
+	if err != nil {
+		return writers, err
+	}
+	return writers, nil
+}
+
+func putWriters(fileKey []byte, fileMacKey []byte, writeKey []byte, writers FileWriters) (err error) {
+	return fileEncThenTag(fileKey, fileMacKey, writeKey, writers, getUUID("writers", string(fileKey)))
+}
+
+// Store a file's data like symEncThenTag, except that a signed file's data is signed with
+// its writer key instead of tagged, so readers can check it without being able to forge it.
+// The write key is nil for files that aren't signed and for their readers
+func fileEncThenTag(fileKey []byte, fileMacKey []byte, writeKey []byte, content interface{}, id uuid.UUID) (err error) {
+	if _, signed := writerVerifyKey(fileKey); !signed {
+		return symEncThenTag(fileKey, fileMacKey, content, id)
+	}
+	if writeKey == nil {
+		return ErrReadOnly
+	}
+	signKey, err := getSignKey(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+
+	marshalContent, err := json.Marshal(content)
+	if err != nil {
+		return err
+	}
+	encContent := userlib.SymEnc(fileKey[:16], userlib.RandomBytes(16), marshalContent)
+
+	sig, err := userlib.DSSign(signKey, encContent)
+	if err != nil {
+		return err
+	}
+	userlib.DatastoreSet(id, append(sig, encContent...))
+
+	return nil
+}
+
+// Verify then decrypt a file's data stored by fileEncThenTag
+func fileVerifyThenDec(fileKey []byte, fileMacKey []byte, id uuid.UUID) (content []byte, err error) {
+	verifyKey, signed := writerVerifyKey(fileKey)
+	if !signed {
+		return symVerifyThenDec(fileKey, fileMacKey, id)
+	}
+
+	dataStoreEntry, ok := userlib.DatastoreGet(id)
+	if !ok {
+		return content, errors.New("datastore entry at Id does not exist")
+	}
+	if len(dataStoreEntry) < 256+userlib.AESBlockSizeBytes {
+		return content, errors.New("tampering has occurred")
+	}
+
+	sig := dataStoreEntry[:256]
+	encMarshalContent := dataStoreEntry[256:]
+	err = userlib.DSVerify(verifyKey, encMarshalContent, sig)
+	if err != nil {
+		return content, errors.New("signature does not match, content has been changed")
+	}
+
+	content = userlib.SymDec(fileKey[:16], encMarshalContent)
 
 	return content, nil
 }
 
 // Get file keys from datastore (may need to verify with owner's DS key)
 func getFileKeys(user *User, filename string) (fileKey []byte, fileMacKey []byte, err error) {
+	filename, err = resolveLink(user, filename)
+	if err != nil {
+		return fileKey, fileMacKey, err
+	}
+
 	// Verify then decrypt file key from datastore
 	keyId := getUUID(filename+"key", user.Username)
 	fileKeyEntry, err := symVerifyThenDec(user.encKey, user.macKey, keyId)
@@ -216,518 +799,4799 @@ func getFileKeys(user *User, filename string) (fileKey []byte, fileMacKey []byte
 	return fileKey, fileMacKey, nil
 }
 
-func getFileHead(fileKey []byte, fileMacKey []byte, filename string, username string) (fileHead FileHead, fileHeadId uuid.UUID, err error) {
+// Get a signed file's write key, nil for read-only recipients who were never given one.
+// Like the file key, the owner may have replaced it after revoking someone
+func getWriteKey(user *User, filename string) (writeKey []byte, err error) {
+	writeKeyId := getUUID(filename+"writekey", user.Username)
+	if _, ok := userlib.DatastoreGet(writeKeyId); !ok {
+		return nil, nil
+	}
+
+	// Verify then decrypt write key
+	writeKeyEntry, err := symVerifyThenDec(user.encKey, user.macKey, writeKeyId)
+	if err != nil {
+		ownerName, err := getOwner(user, filename)
+		if err != nil {
+			return writeKey, err
+		}
+		writeKeyEntry, err = asymVerifyThenDec(ownerName, user.PKEDecKey, writeKeyId)
+		if err != nil {
+			return writeKey, err
+		}
+	}
+	err = json.Unmarshal(writeKeyEntry, &writeKey)
+	if err != nil {
+		return writeKey, err
+	}
+	return writeKey, nil
+}
+
+func getFileNode(fileKey []byte, fileMacKey []byte, fileNodeId uuid.UUID) (fileNode FileNode, err error) {
 	// Verify then decrypt file node
-	fileNodeId := getUUID(filename, username)
 	fileNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, fileNodeId)
 	if err != nil {
-		return fileHead, fileHeadId, err
+		return fileNode, err
 	}
-	var fileNode FileNode
 	err = json.Unmarshal(fileNodeEntry, &fileNode)
 	if err != nil {
-		return fileHead, fileHeadId, err
+		return fileNode, err
 	}
+	return fileNode, nil
+}
 
-	// Verify then decrypt file head
-	fileHeadEntry, err := symVerifyThenDec(fileKey, fileMacKey, fileNode.FileHead)
+// Verify then decrypt a file head, finishing the publication of a batch it's part of if the
+// batch has committed. Until then the published head stands
+func loadFileHead(fileKey []byte, fileMacKey []byte, writeKey []byte, fileHeadId uuid.UUID) (fileHead FileHead, err error) {
+	fileHeadEntry, err := fileVerifyThenDec(fileKey, fileMacKey, fileHeadId)
 	if err != nil {
-		return fileHead, fileHeadId, err
+		return fileHead, err
 	}
 	err = json.Unmarshal(fileHeadEntry, &fileHead)
 	if err != nil {
-		return fileHead, fileHeadId, err
+		return fileHead, err
+	}
+	if fileHead.Batch == uuid.Nil {
+		return fileHead, nil
 	}
 
-	return fileHead, fileNode.FileHead, nil
-}
-
-func cleanFileTree(fileKey []byte, newFileKey []byte, fileNodeId uuid.UUID, head uuid.UUID, sign userlib.DSSignKey) (err error) {
-	// Derive MAC keys
-	fileMacKey, err := userlib.HashKDF(fileKey, []byte("mac-key"))
-	if err != nil {
-		return err
+	token, ok := userlib.DatastoreGet(fileHead.Batch)
+	if !ok || !userlib.HMACEqual(userlib.Hash(token), fileHead.BatchHash) {
+		fileHead.Batch = uuid.Nil
+		fileHead.BatchHash = nil
+		fileHead.Staged = uuid.Nil
+		return fileHead, nil
 	}
-	newFileMacKey, err := userlib.HashKDF(newFileKey, []byte("mac-key"))
+	// Publishing changes the file, which readers of a signed file can't do for its writer
+	err = checkWritable(fileKey, writeKey)
 	if err != nil {
-		return err
+		return fileHead, errors.New("file is partway through publishing a batch")
 	}
-
-	// Get file node
-	fileNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, fileNodeId)
+	stagedEntry, err := fileVerifyThenDec(fileKey, fileMacKey, fileHead.Staged)
 	if err != nil {
-		return err
+		return fileHead, err
 	}
-	var fileNode FileNode
-	err = json.Unmarshal(fileNodeEntry, &fileNode)
+	var staged FileHead
+	err = json.Unmarshal(stagedEntry, &staged)
 	if err != nil {
-		return err
+		return fileHead, err
 	}
+	return publishFileHead(fileKey, fileMacKey, writeKey, fileHeadId, staged)
+}
 
-	newChildren := fileNode.Children
-	for _, id := range fileNode.Children {
-		// Verify then decrypt child file node
-		childFileNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, id)
+// Link a staged head's appended chain and store it as the file's head. Safe to repeat, so
+// readers can finish a batch whose writer stopped after committing
+func publishFileHead(fileKey []byte, fileMacKey []byte, writeKey []byte, fileHeadId uuid.UUID, staged FileHead) (fileHead FileHead, err error) {
+	if staged.LinkNode != uuid.Nil {
+		lastNode, err := getContentNode(fileKey, fileMacKey, staged.LinkNode)
 		if err != nil {
-			return err
+			return fileHead, err
 		}
-		var childFileNode FileNode
-		err = json.Unmarshal(childFileNodeEntry, &childFileNode)
+		lastNode.NextNode = staged.LinkTo
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, lastNode, staged.LinkNode)
 		if err != nil {
-			return err
+			return fileHead, err
 		}
-
-		cleanFileTree(fileKey, newFileKey, id, head, sign)
 	}
-	// Update values for file node
-	fileNode.Children = newChildren
-	fileNode.FileHead = head
-	err = symEncThenTag(newFileKey, newFileMacKey, fileNode, fileNodeId)
+
+	fileHead = staged
+	fileHead.Batch = uuid.Nil
+	fileHead.BatchHash = nil
+	fileHead.Staged = uuid.Nil
+	fileHead.LinkNode = uuid.Nil
+	fileHead.LinkTo = uuid.Nil
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
 	if err != nil {
-		return err
+		return fileHead, err
 	}
+	return fileHead, nil
+}
 
-	// Store new file key for current user
-	fileKeyId := getUUID(fileNode.Filename+"key", fileNode.Username)
-	err = asymEncThenTag(fileNode.Username, sign, newFileKey, fileKeyId)
+func getFileHead(fileKey []byte, fileMacKey []byte, writeKey []byte, fileNodeId uuid.UUID) (fileHead FileHead, fileHeadId uuid.UUID, err error) {
+	// Verify then decrypt file node
+	fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
 	if err != nil {
-		return err
+		return fileHead, fileHeadId, err
+	}
+	if fileNode.IsDir {
+		return fileHead, fileHeadId, errors.New("path is a directory")
+	}
+	fileHeadId, err = getFileHeadId(fileKey, fileMacKey, fileNode)
+	if err != nil {
+		return fileHead, fileHeadId, err
 	}
 
-	return nil
+	// Verify then decrypt file head
+	fileHead, err = loadFileHead(fileKey, fileMacKey, writeKey, fileHeadId)
+	if err != nil {
+		return fileHead, fileHeadId, err
+	}
+
+	return fileHead, fileHeadId, nil
+}
+
+// Where a file's head is. Readers can point nodes elsewhere, so a signed file's head is
+// taken from its writer record instead
+func getFileHeadId(fileKey []byte, fileMacKey []byte, fileNode FileNode) (fileHeadId uuid.UUID, err error) {
+	if _, signed := writerVerifyKey(fileKey); !signed {
+		return fileNode.FileHead, nil
+	}
+	writers, err := getWriters(fileKey, fileMacKey)
+	if err != nil {
+		return fileHeadId, err
+	}
+	return writers.Head, nil
+}
+
+func getContentNode(fileKey []byte, fileMacKey []byte, contentNodeId uuid.UUID) (contentNode ContentNode, err error) {
+	// Verify then decrypt content node
+	contentNodeEntry, err := fileVerifyThenDec(fileKey, fileMacKey, contentNodeId)
+	if err != nil {
+		return contentNode, err
+	}
+	err = json.Unmarshal(contentNodeEntry, &contentNode)
+	if err != nil {
+		return contentNode, err
+	}
+	return contentNode, nil
+}
+
+func getContents(contentNode ContentNode) (contents []byte, err error) {
+	macKey, err := userlib.HashKDF(contentNode.Key, []byte("mac-key"))
+	if err != nil {
+		return contents, err
+	}
+
+	// Verify then decrypt contents, then check they're what this node stored
+	contentEntry, err := symVerifyThenDec(contentNode.Key, macKey, contentNode.Contents)
+	if err != nil {
+		return contents, err
+	}
+	err = json.Unmarshal(contentEntry, &contents)
+	if err != nil {
+		return contents, err
+	}
+	contents, err = decompressContents(contents, contentNode.Compression)
+	if err != nil {
+		return contents, err
+	}
+	if !userlib.HMACEqual(userlib.Hash(contents), contentNode.Hash) {
+		return contents, errors.New("contents do not match content node")
+	}
+	return contents, nil
+}
+
+// Encrypt contents, compressed as the file head says, under a fresh key at a fresh UUID, or
+// under dedupKey if there is one, and point the node at them. Caller stores the node and
+// releases whatever it pointed at before
+func putContents(contentNode *ContentNode, contents []byte, fileHead *FileHead, dedupKey []byte) (err error) {
+	stored, compression, err := compressContents(contents, fileHead.Compression, fileHead.PadCompressed)
+	if err != nil {
+		return err
+	}
+
+	key := userlib.RandomBytes(16)
+	contentsId := uuid.New()
+	if dedupKey != nil {
+		// The same stored bytes always get the same key and UUID in all of the owner's files,
+		// so contents already there are shared instead of uploaded again
+		digest, err := userlib.HMACEval(dedupKey, append([]byte(compression+":"), stored...))
+		if err != nil {
+			return err
+		}
+		key = digest[:16]
+		contentsId, err = uuid.FromBytes(digest[16:32])
+		if err != nil {
+			return err
+		}
+		if _, ok := userlib.DatastoreGet(contentsId); ok {
+			contentNode.Contents = contentsId
+			contentNode.Key = key
+			err = retainContents(*contentNode)
+			if err != nil {
+				return err
+			}
+			contentNode.Hash = userlib.Hash(contents)
+			contentNode.Size = len(contents)
+			contentNode.Compression = compression
+			return nil
+		}
+	}
+
+	macKey, err := userlib.HashKDF(key, []byte("mac-key"))
+	if err != nil {
+		return err
+	}
+	err = symEncThenTag(key, macKey, stored, contentsId)
+	if err != nil {
+		return err
+	}
+	contentNode.Contents = contentsId
+	contentNode.Key = key
+	contentNode.Hash = userlib.Hash(contents)
+	contentNode.Size = len(contents)
+	contentNode.Compression = compression
+	return nil
+}
+
+// Compress contents for storage, keeping them as they are if that doesn't make them smaller.
+// Padding rounds compressed contents up to a power of two, so their size only says roughly
+// how well they compressed
+func compressContents(contents []byte, compression string, pad bool) (stored []byte, used string, err error) {
+	if compression == CompressNone {
+		return contents, CompressNone, nil
+	}
+	if compression != CompressDeflate {
+		return stored, used, errors.New("unknown compression")
+	}
+
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.BestCompression)
+	if err != nil {
+		return stored, used, err
+	}
+	_, err = writer.Write(contents)
+	if err != nil {
+		return stored, used, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return stored, used, err
+	}
+	stored = buffer.Bytes()
+
+	// DEFLATE streams mark their own end, so readers ignore the padding
+	if pad {
+		size := 1
+		for size < len(stored) {
+			size *= 2
+		}
+		stored = append(stored, make([]byte, size-len(stored))...)
+	}
+	if len(stored) >= len(contents) {
+		return contents, CompressNone, nil
+	}
+	return stored, compression, nil
+}
+
+func decompressContents(stored []byte, compression string) (contents []byte, err error) {
+	switch compression {
+	case CompressNone:
+		return stored, nil
+	case CompressDeflate:
+		return io.ReadAll(flate.NewReader(bytes.NewReader(stored)))
+	}
+	return contents, errors.New("unknown compression")
+}
+
+// Number of content nodes sharing a node's contents, a missing record means just the one
+func getRefs(contentNode ContentNode) (refs int, refsId uuid.UUID, refsKey []byte, err error) {
+	refsId, err = uuid.FromBytes(userlib.Hash(append(contentNode.Contents[:], []byte("refs")...))[:16])
+	if err != nil {
+		return refs, refsId, refsKey, err
+	}
+	refsKey, err = userlib.HashKDF(contentNode.Key, []byte("refs"))
+	if err != nil {
+		return refs, refsId, refsKey, err
+	}
+	if _, ok := userlib.DatastoreGet(refsId); !ok {
+		return 1, refsId, refsKey, nil
+	}
+
+	// Verify then decrypt the count
+	refsEntry, err := symVerifyThenDec(refsKey, refsKey[16:], refsId)
+	if err != nil {
+		return refs, refsId, refsKey, err
+	}
+	err = json.Unmarshal(refsEntry, &refs)
+	if err != nil {
+		return refs, refsId, refsKey, err
+	}
+	return refs, refsId, refsKey, nil
+}
+
+// Record another content node sharing a node's contents
+func retainContents(contentNode ContentNode) (err error) {
+	refs, refsId, refsKey, err := getRefs(contentNode)
+	if err != nil {
+		return err
+	}
+	return symEncThenTag(refsKey, refsKey[16:], refs+1, refsId)
+}
+
+// Drop a content node's reference to its contents, deleting them once nothing else shares them
+func releaseContents(contentNode ContentNode) (err error) {
+	refs, refsId, refsKey, err := getRefs(contentNode)
+	if err != nil {
+		return err
+	}
+	if refs > 1 {
+		return symEncThenTag(refsKey, refsKey[16:], refs-1, refsId)
+	}
+	userlib.DatastoreDelete(contentNode.Contents)
+	userlib.DatastoreDelete(refsId)
+	return nil
+}
+
+// Record a content node starting at offset in the file's index. Caller stores the file head
+func addToIndex(fileKey []byte, fileMacKey []byte, writeKey []byte, fileHead *FileHead, contentNodeId uuid.UUID, offset int) (err error) {
+	var page IndexPage
+	pageId := uuid.New()
+
+	// Fill up the last page before starting a new one
+	last := len(fileHead.IndexPages) - 1
+	if last >= 0 {
+		pageEntry, err := fileVerifyThenDec(fileKey, fileMacKey, fileHead.IndexPages[last])
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(pageEntry, &page)
+		if err != nil {
+			return err
+		}
+		if len(page.Nodes) < indexPageSize {
+			pageId = fileHead.IndexPages[last]
+		} else {
+			page = IndexPage{}
+		}
+	}
+	if last < 0 || pageId != fileHead.IndexPages[last] {
+		fileHead.IndexPages = append(fileHead.IndexPages, pageId)
+		fileHead.PageOffsets = append(fileHead.PageOffsets, offset)
+	}
+
+	page.Nodes = append(page.Nodes, contentNodeId)
+	page.Offsets = append(page.Offsets, offset)
+	return fileEncThenTag(fileKey, fileMacKey, writeKey, page, pageId)
+}
+
+// Find the last content node starting at or before offset using the index. Returns the
+// index page holding it along with its position, page p and entry n
+func findContentNode(fileKey []byte, fileMacKey []byte, fileHead FileHead, offset int) (page IndexPage, p int, n int, err error) {
+	if len(fileHead.IndexPages) == 0 {
+		return page, p, n, errors.New("file has no index")
+	}
+
+	// Find last index page starting at or before offset
+	for p+1 < len(fileHead.PageOffsets) && fileHead.PageOffsets[p+1] <= offset {
+		p++
+	}
+	pageEntry, err := fileVerifyThenDec(fileKey, fileMacKey, fileHead.IndexPages[p])
+	if err != nil {
+		return page, p, n, err
+	}
+	err = json.Unmarshal(pageEntry, &page)
+	if err != nil {
+		return page, p, n, err
+	}
+	if len(page.Nodes) == 0 || len(page.Nodes) != len(page.Offsets) {
+		return page, p, n, errors.New("index page is malformed")
+	}
+
+	// Then the last content node in that page starting at or before offset
+	for n+1 < len(page.Offsets) && page.Offsets[n+1] <= offset {
+		n++
+	}
+	return page, p, n, nil
+}
+
+// Random-looking value per byte for the rolling hash used by content-defined chunking
+var gearTable = makeGearTable()
+
+func makeGearTable() (table [256]uint32) {
+	for i := range table {
+		hash := userlib.Hash([]byte{byte(i)})
+		table[i] = uint32(hash[0])<<24 | uint32(hash[1])<<16 | uint32(hash[2])<<8 | uint32(hash[3])
+	}
+	return table
+}
+
+// Length of the next chunk to store from content. Deduplicated files cut where a rolling hash
+// of the last few bytes matches a pattern, so the same data splits the same way wherever it
+// sits in a file. Their chunks are a quarter of ChunkSize at least and about half on average
+func nextChunkSize(fileHead *FileHead, content []byte) int {
+	size := len(content)
+	if size > ChunkSize {
+		size = ChunkSize
+	}
+	if !fileHead.Dedup {
+		return size
+	}
+
+	minSize := ChunkSize / 4
+	bits := uint(0)
+	for bits < 32 && 1<<(bits+1) <= minSize {
+		bits++
+	}
+	mask := uint32(1<<bits-1) << (32 - bits)
+	var hash uint32
+	for i := 0; i < size; i++ {
+		hash = hash<<1 + gearTable[content[i]]
+		if i+1 >= minSize && hash&mask == 0 {
+			return i + 1
+		}
+	}
+	return size
+}
+
+// Store content as a linked run of content nodes of at most ChunkSize bytes each, indexing
+// them after the file's current end. Caller links the run into the file and stores the head
+func writeChunks(fileKey []byte, fileMacKey []byte, writeKey []byte, dedupKey []byte, fileHead *FileHead, content []byte) (firstNodeId uuid.UUID, lastNodeId uuid.UUID, err error) {
+	err = checkSettings()
+	if err != nil {
+		return firstNodeId, lastNodeId, err
+	}
+
+	firstNodeId = uuid.New()
+	contentNodeId := firstNodeId
+	for {
+		size := nextChunkSize(fileHead, content)
+
+		var contentNode ContentNode
+		contentNode.NextNode = uuid.Nil
+		if size < len(content) {
+			contentNode.NextNode = uuid.New()
+		}
+
+		// Encrypt chunk and node then index it
+		err = putContents(&contentNode, content[:size], fileHead, dedupKey)
+		if err != nil {
+			return firstNodeId, lastNodeId, err
+		}
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, contentNode, contentNodeId)
+		if err != nil {
+			return firstNodeId, lastNodeId, err
+		}
+		err = addToIndex(fileKey, fileMacKey, writeKey, fileHead, contentNodeId, fileHead.Size)
+		if err != nil {
+			return firstNodeId, lastNodeId, err
+		}
+		fileHead.Size += size
+		fileHead.NumNodes++
+
+		content = content[size:]
+		if contentNode.NextNode == uuid.Nil {
+			return firstNodeId, contentNodeId, nil
+		}
+		contentNodeId = contentNode.NextNode
+	}
+}
+
+// Convergent key for the chunks user writes to a file. Only the owner's writes to a
+// deduplicated file have one, so chunks are shared across the owner's files and nobody else
+// can work out where any chunk of them is stored
+func chunkKey(user *User, fileHead FileHead) []byte {
+	if !fileHead.Dedup || fileHead.Owner != user.Username {
+		return nil
+	}
+	return user.dedupKey
+}
+
+// Write content after the file's last node, or as its only nodes if it has none yet.
+// Caller stores the head
+func appendChunks(fileKey []byte, fileMacKey []byte, writeKey []byte, dedupKey []byte, fileHead *FileHead, content []byte) (err error) {
+	firstNewNodeId, lastNewNodeId, err := writeChunks(fileKey, fileMacKey, writeKey, dedupKey, fileHead, content)
+	if err != nil {
+		return err
+	}
+	if fileHead.FirstNode == uuid.Nil {
+		fileHead.FirstNode = firstNewNodeId
+		fileHead.LastNode = lastNewNodeId
+		return nil
+	}
+
+	// Link new content nodes after the last one
+	lastNode, err := getContentNode(fileKey, fileMacKey, fileHead.LastNode)
+	if err != nil {
+		return err
+	}
+	lastNode.NextNode = firstNewNodeId
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, lastNode, fileHead.LastNode)
+	if err != nil {
+		return err
+	}
+	fileHead.LastNode = lastNewNodeId
+	return nil
+}
+
+// Rewrite a file's chain into as few nodes as ChunkSize allows. The new chain is swapped in
+// with one write to the same file head, so recipients keep their access. The old chain is
+// only retired so readers partway through it can finish, and is deleted by the next compaction
+func compactFile(user *User, fileKey []byte, fileMacKey []byte, writeKey []byte, fileHeadId uuid.UUID) (err error) {
+	// Verify then decrypt file head
+	fileHead, err := loadFileHead(fileKey, fileMacKey, writeKey, fileHeadId)
+	if err != nil {
+		return err
+	}
+	err = checkSettings()
+	if err != nil {
+		return err
+	}
+
+	// Build new chain, writing out full chunks as soon as they're available
+	newFileHead := fileHead
+	newFileHead.FirstNode = uuid.Nil
+	newFileHead.LastNode = uuid.Nil
+	newFileHead.Size = 0
+	newFileHead.NumNodes = 0
+	newFileHead.IndexPages = nil
+	newFileHead.PageOffsets = nil
+
+	var buffer []byte
+	contentNodeId := fileHead.FirstNode
+	for contentNodeId != uuid.Nil {
+		contentNode, err := getContentNode(fileKey, fileMacKey, contentNodeId)
+		if err != nil {
+			return err
+		}
+		contents, err := getContents(contentNode)
+		if err != nil {
+			return err
+		}
+		buffer = append(buffer, contents...)
+		contentNodeId = contentNode.NextNode
+
+		// Chunks are cut the same way whatever follows them once ChunkSize bytes are buffered
+		full := 0
+		for len(buffer)-full >= ChunkSize {
+			full += nextChunkSize(&newFileHead, buffer[full:])
+		}
+		if full > 0 {
+			err = appendChunks(fileKey, fileMacKey, writeKey, chunkKey(user, newFileHead), &newFileHead, buffer[:full])
+			if err != nil {
+				return err
+			}
+			buffer = buffer[full:]
+		}
+	}
+	if len(buffer) > 0 || newFileHead.FirstNode == uuid.Nil {
+		err = appendChunks(fileKey, fileMacKey, writeKey, chunkKey(user, newFileHead), &newFileHead, buffer)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Previously retired chain has had a whole compaction to be finished with
+	err = deleteRetired(fileKey, fileMacKey, &newFileHead)
+	if err != nil {
+		return err
+	}
+	newFileHead.RetiredNode = fileHead.FirstNode
+	newFileHead.RetiredPages = fileHead.IndexPages
+	newFileHead.RetiredSize = fileHead.Size
+	newFileHead.RetiredNodes = fileHead.NumNodes
+
+	// Swap in the new chain
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, newFileHead, fileHeadId)
+	if err != nil {
+		return err
+	}
+
+	return chargeUsage(user, fileHead, newFileHead)
+}
+
+// Delete the chain and index left behind by the last compaction. Caller stores the head and
+// charges it
+func deleteRetired(fileKey []byte, fileMacKey []byte, fileHead *FileHead) (err error) {
+	err = deleteChain(fileKey, fileMacKey, fileHead.RetiredNode)
+	if err != nil {
+		return err
+	}
+	for _, pageId := range fileHead.RetiredPages {
+		userlib.DatastoreDelete(pageId)
+	}
+	fileHead.RetiredNode = uuid.Nil
+	fileHead.RetiredPages = nil
+	fileHead.RetiredSize = 0
+	fileHead.RetiredNodes = 0
+	return nil
+}
+
+// Give an empty head its own nodes sharing the contents of a chain, which may be under
+// another file key. Edits to either side write new contents rather than changing shared ones
+func copyChain(srcKey []byte, srcMacKey []byte, dstKey []byte, dstMacKey []byte, dstWriteKey []byte, dstHead *FileHead, contentNodeId uuid.UUID) (err error) {
+	newNodeId := uuid.New()
+	dstHead.FirstNode = newNodeId
+	for contentNodeId != uuid.Nil {
+		contentNode, err := getContentNode(srcKey, srcMacKey, contentNodeId)
+		if err != nil {
+			return err
+		}
+		err = retainContents(contentNode)
+		if err != nil {
+			return err
+		}
+		contentNodeId = contentNode.NextNode
+		if contentNode.NextNode != uuid.Nil {
+			contentNode.NextNode = uuid.New()
+		}
+
+		// Encrypt then tag new content node and index it
+		err = fileEncThenTag(dstKey, dstMacKey, dstWriteKey, contentNode, newNodeId)
+		if err != nil {
+			return err
+		}
+		err = addToIndex(dstKey, dstMacKey, dstWriteKey, dstHead, newNodeId, dstHead.Size)
+		if err != nil {
+			return err
+		}
+		dstHead.Size += contentNode.Size
+		dstHead.NumNodes++
+		dstHead.LastNode = newNodeId
+		newNodeId = contentNode.NextNode
+	}
+	return nil
+}
+
+// Keep a file's current content as a version, then drop the oldest ones past the file's
+// limit. Empty content is kept too, so every overwrite can be undone. Caller gives the head
+// a new chain and stores it
+func saveVersion(fileKey []byte, fileMacKey []byte, writeKey []byte, fileHead *FileHead) (err error) {
+	err = stageVersion(fileKey, fileMacKey, writeKey, fileHead)
+	if err != nil {
+		return err
+	}
+	return pruneVersions(fileKey, fileMacKey, fileHead)
+}
+
+// Keep a file's current content as a version without deleting anything. Caller prunes
+// versions
+func stageVersion(fileKey []byte, fileMacKey []byte, writeKey []byte, fileHead *FileHead) (err error) {
+	snapshot := *fileHead
+	snapshot.Versions = nil
+	snapshot.RetiredNode = uuid.Nil
+	snapshot.RetiredPages = nil
+	snapshot.RetiredSize = 0
+	snapshot.RetiredNodes = 0
+	versionId := uuid.New()
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, snapshot, versionId)
+	if err != nil {
+		return err
+	}
+	fileHead.Versions = append(fileHead.Versions, versionId)
+	fileHead.Version++
+	fileHead.VersionBytes += fileHead.Size
+	fileHead.VersionNodes += fileHead.NumNodes
+
+	fileHead.FirstNode = uuid.Nil
+	fileHead.LastNode = uuid.Nil
+	fileHead.Size = 0
+	fileHead.NumNodes = 0
+	fileHead.IndexPages = nil
+	fileHead.PageOffsets = nil
+	return nil
+}
+
+// Delete the oldest versions until the file is within its limit. Caller stores the head
+func pruneVersions(fileKey []byte, fileMacKey []byte, fileHead *FileHead) (err error) {
+	for len(fileHead.Versions) > fileHead.MaxVersions {
+		snapshot, err := getVersion(fileKey, fileMacKey, fileHead.Versions[0])
+		if err != nil {
+			return err
+		}
+		err = deleteChain(fileKey, fileMacKey, snapshot.FirstNode)
+		if err != nil {
+			return err
+		}
+		deleteIndex(&snapshot)
+		userlib.DatastoreDelete(fileHead.Versions[0])
+		fileHead.Versions = fileHead.Versions[1:]
+		fileHead.VersionBytes -= snapshot.Size
+		fileHead.VersionNodes -= snapshot.NumNodes
+	}
+	return nil
+}
+
+func getVersion(fileKey []byte, fileMacKey []byte, versionId uuid.UUID) (snapshot FileHead, err error) {
+	// Verify then decrypt version's file head
+	snapshotEntry, err := fileVerifyThenDec(fileKey, fileMacKey, versionId)
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(snapshotEntry, &snapshot)
+	if err != nil {
+		return snapshot, err
+	}
+	return snapshot, nil
+}
+
+// Find a file's version by number
+func findVersion(fileKey []byte, fileMacKey []byte, fileHead FileHead, version int) (snapshot FileHead, err error) {
+	for _, versionId := range fileHead.Versions {
+		snapshot, err = getVersion(fileKey, fileMacKey, versionId)
+		if err != nil {
+			return snapshot, err
+		}
+		if snapshot.Version == version {
+			return snapshot, nil
+		}
+	}
+	return snapshot, errors.New("version does not exist")
+}
+
+// Move a file's versions under a new file key. Their contents stay where they are, anyone
+// who could read them did before the revocation and the nodes' hashes still protect them
+func rekeyVersions(fileKey []byte, fileMacKey []byte, newFileKey []byte, newFileMacKey []byte, newWriteKey []byte, fileHead *FileHead) (err error) {
+	var versions []uuid.UUID
+	for _, versionId := range fileHead.Versions {
+		snapshot, err := getVersion(fileKey, fileMacKey, versionId)
+		if err != nil {
+			return err
+		}
+		newSnapshot := snapshot
+		newSnapshot.Size = 0
+		newSnapshot.NumNodes = 0
+		newSnapshot.IndexPages = nil
+		newSnapshot.PageOffsets = nil
+		err = copyChain(fileKey, fileMacKey, newFileKey, newFileMacKey, newWriteKey, &newSnapshot, snapshot.FirstNode)
+		if err != nil {
+			return err
+		}
+
+		// Delete old nodes, index and version head
+		err = deleteChain(fileKey, fileMacKey, snapshot.FirstNode)
+		if err != nil {
+			return err
+		}
+		deleteIndex(&snapshot)
+		userlib.DatastoreDelete(versionId)
+
+		newVersionId := uuid.New()
+		err = fileEncThenTag(newFileKey, newFileMacKey, newWriteKey, newSnapshot, newVersionId)
+		if err != nil {
+			return err
+		}
+		versions = append(versions, newVersionId)
+	}
+	fileHead.Versions = versions
+	return nil
+}
+
+// Delete a file head along with its chain, index and versions
+func deleteFileData(user *User, fileKey []byte, fileMacKey []byte, writeKey []byte, fileHeadId uuid.UUID) (err error) {
+	// Verify then decrypt file head
+	fileHead, err := loadFileHead(fileKey, fileMacKey, writeKey, fileHeadId)
+	if err != nil {
+		return err
+	}
+
+	before := fileHead
+
+	err = deleteChain(fileKey, fileMacKey, fileHead.FirstNode)
+	if err != nil {
+		return err
+	}
+	deleteIndex(&fileHead)
+	err = deleteRetired(fileKey, fileMacKey, &fileHead)
+	if err != nil {
+		return err
+	}
+	fileHead.MaxVersions = 0
+	err = pruneVersions(fileKey, fileMacKey, &fileHead)
+	if err != nil {
+		return err
+	}
+	userlib.DatastoreDelete(fileHeadId)
+	return chargeUsage(user, before, FileHead{Owner: fileHead.Owner, UsageKey: fileHead.UsageKey})
+}
+
+// Delete every content node in a chain along with its contents
+func deleteChain(fileKey []byte, fileMacKey []byte, contentNodeId uuid.UUID) (err error) {
+	for contentNodeId != uuid.Nil {
+		contentNode, err := getContentNode(fileKey, fileMacKey, contentNodeId)
+		if err != nil {
+			return err
+		}
+		err = releaseContents(contentNode)
+		if err != nil {
+			return err
+		}
+		userlib.DatastoreDelete(contentNodeId)
+		contentNodeId = contentNode.NextNode
+	}
+	return nil
+}
+
+// Delete all index pages of a file. Caller stores the file head
+func deleteIndex(fileHead *FileHead) {
+	for _, pageId := range fileHead.IndexPages {
+		userlib.DatastoreDelete(pageId)
+	}
+	fileHead.IndexPages = nil
+	fileHead.PageOffsets = nil
+}
+
+// FileNodes are stored at a random UUID kept under the user's keys, so a file that moves to
+// another path keeps its place in the sharing tree and invitations sent from it stay valid.
+// Files created before that have theirs at the path's UUID
+func getFileNodeId(user *User, filename string) (fileNodeId uuid.UUID, err error) {
+	nodeId := getUUID(filename+"node", user.Username)
+	if _, ok := userlib.DatastoreGet(nodeId); !ok {
+		return getUUID(filename, user.Username), nil
+	}
+
+	// Verify then decrypt node UUID
+	nodeEntry, err := symVerifyThenDec(user.encKey, user.macKey, nodeId)
+	if err != nil {
+		return fileNodeId, err
+	}
+	err = json.Unmarshal(nodeEntry, &fileNodeId)
+	if err != nil {
+		return fileNodeId, err
+	}
+	return fileNodeId, nil
+}
+
+// Pick a UUID for a new FileNode and remember it for the path
+func newFileNodeId(user *User, filename string) (fileNodeId uuid.UUID, err error) {
+	fileNodeId = uuid.New()
+	return fileNodeId, symEncThenTag(user.encKey, user.macKey, fileNodeId, getUUID(filename+"node", user.Username))
+}
+
+// Find a file's node and keys. Files in the user's own namespace have their keys stored
+// per user, while files inside a shared folder are found through the folder's listing
+func lookupFile(user *User, filename string) (fileNodeId uuid.UUID, fileKey []byte, fileMacKey []byte, writeKey []byte, err error) {
+	filename, err = resolveLink(user, filename)
+	if err != nil {
+		return fileNodeId, fileKey, fileMacKey, writeKey, err
+	}
+
+	// Every use of an owner's file first revokes access that has run out, and every lookup
+	// purges trashed files past the retention period and lists files from stopped batches
+	err = expireGrants(user, filename)
+	if err != nil {
+		return fileNodeId, fileKey, fileMacKey, writeKey, err
+	}
+	err = expireTrash(user)
+	if err != nil {
+		return fileNodeId, fileKey, fileMacKey, writeKey, err
+	}
+	err = finishBatches(user)
+	if err != nil {
+		return fileNodeId, fileKey, fileMacKey, writeKey, err
+	}
+	fileKey, fileMacKey, err = getFileKeys(user, filename)
+	if _, ok := userlib.DatastoreGet(getUUID(filename+"key", user.Username)); ok || err == nil {
+		if err != nil {
+			return fileNodeId, fileKey, fileMacKey, writeKey, err
+		}
+		fileNodeId, err = getFileNodeId(user, filename)
+		if err != nil {
+			return fileNodeId, fileKey, fileMacKey, writeKey, err
+		}
+
+		// Writers of a signed file also hold its write key, once it's known the owner
+		// registered the key that checks it
+		if _, signed := writerVerifyKey(fileKey); signed {
+			ownerName, err := getOwner(user, filename)
+			if err != nil {
+				return fileNodeId, fileKey, fileMacKey, writeKey, err
+			}
+			err = checkWriterBinding(fileKey, fileMacKey, ownerName)
+			if err != nil {
+				return fileNodeId, fileKey, fileMacKey, writeKey, err
+			}
+			writeKey, err = getWriteKey(user, filename)
+		}
+		return fileNodeId, fileKey, fileMacKey, writeKey, err
+	}
+	if _, ok := userlib.DatastoreGet(getUUID(filename+"drop", user.Username)); ok {
+		return fileNodeId, fileKey, fileMacKey, writeKey, ErrAppendOnly
+	}
+
+	parent, name := splitPath(filename)
+	if !strings.Contains(filename, "/") {
+		return fileNodeId, fileKey, fileMacKey, writeKey, errNotFound
+	}
+	dir, _, _, _, err := getDirectory(user, parent)
+	if err != nil {
+		return fileNodeId, fileKey, fileMacKey, writeKey, err
+	}
+	if !dir.Shared {
+		return fileNodeId, fileKey, fileMacKey, writeKey, errNotFound
+	}
+	for _, entry := range dir.Entries {
+		if entry.Name == name && !entry.IsDir {
+			fileMacKey, err = userlib.HashKDF(entry.Key, []byte("mac-key"))
+			if err != nil {
+				return fileNodeId, fileKey, fileMacKey, writeKey, err
+			}
+			return entry.Node, entry.Key, fileMacKey, nil, nil
+		}
+	}
+	return fileNodeId, fileKey, fileMacKey, writeKey, errNotFound
+}
+
+// Extra names a file is linked under only record its path, so every other per-user record
+// stays under that one path. Anything else is its own path
+func resolveLink(user *User, filename string) (target string, err error) {
+	linkId := getUUID(filename+"link", user.Username)
+	if _, ok := userlib.DatastoreGet(linkId); !ok {
+		return filename, nil
+	}
+
+	// Verify then decrypt link
+	linkEntry, err := symVerifyThenDec(user.encKey, user.macKey, linkId)
+	if err != nil {
+		return target, err
+	}
+	err = json.Unmarshal(linkEntry, &target)
+	if err != nil {
+		return target, err
+	}
+	return target, nil
+}
+
+// Names linked to a file, stored under its path
+func getLinks(user *User, filename string) (links []string, err error) {
+	linksId := getUUID(filename+"links", user.Username)
+	if _, ok := userlib.DatastoreGet(linksId); !ok {
+		return nil, nil
+	}
+
+	// Verify then decrypt links
+	linksEntry, err := symVerifyThenDec(user.encKey, user.macKey, linksId)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(linksEntry, &links)
+	if err != nil {
+		return nil, err
+	}
+	return links, nil
+}
+
+func putLinks(user *User, filename string, links []string) (err error) {
+	linksId := getUUID(filename+"links", user.Username)
+	if len(links) == 0 {
+		userlib.DatastoreDelete(linksId)
+		return nil
+	}
+	return symEncThenTag(user.encKey, user.macKey, links, linksId)
+}
+
+// Remove one of a file's extra names, leaving the file under its others
+func unlinkFile(user *User, filename string, target string) (err error) {
+	links, err := getLinks(user, target)
+	if err != nil {
+		return err
+	}
+	for i, link := range links {
+		if link == filename {
+			links = append(links[:i], links[i+1:]...)
+			break
+		}
+	}
+	err = putLinks(user, target, links)
+	if err != nil {
+		return err
+	}
+	userlib.DatastoreDelete(getUUID(filename+"link", user.Username))
+	err = removeDirEntry(user, filename)
+	if err != nil {
+		return err
+	}
+	return unindexFile(user, filename)
+}
+
+// Move a file's records to its first extra name before deleting its path, which then stops
+// being a name for it
+func promoteLink(user *User, filename string, links []string) (err error) {
+	target := links[0]
+	userlib.DatastoreDelete(getUUID(target+"link", user.Username))
+	err = moveFile(user, filename, target)
+	if err != nil {
+		return err
+	}
+	for _, link := range links[1:] {
+		err = symEncThenTag(user.encKey, user.macKey, target, getUUID(link+"link", user.Username))
+		if err != nil {
+			return err
+		}
+	}
+	err = putLinks(user, target, links[1:])
+	if err != nil {
+		return err
+	}
+	err = putLinks(user, filename, nil)
+	if err != nil {
+		return err
+	}
+	err = removeDirEntry(user, filename)
+	if err != nil {
+		return err
+	}
+	return unindexFile(user, filename)
+}
+
+// Owner is stored per user, or on the mount point for files inside a shared folder
+func getOwner(user *User, filename string) (ownerName string, err error) {
+	filename, err = resolveLink(user, filename)
+	if err != nil {
+		return ownerName, err
+	}
+	ownerId := getUUID(filename+"owner", user.Username)
+	ownerEntry, err := symVerifyThenDec(user.encKey, user.macKey, ownerId)
+	if err != nil {
+		mount, mountErr := findMount(user, filename)
+		if mountErr != nil {
+			return ownerName, err
+		}
+		ownerId = getUUID(mount+"owner", user.Username)
+		ownerEntry, err = symVerifyThenDec(user.encKey, user.macKey, ownerId)
+		if err != nil {
+			return ownerName, err
+		}
+	}
+	err = json.Unmarshal(ownerEntry, &ownerName)
+	if err != nil {
+		return ownerName, err
+	}
+	return ownerName, nil
+}
+
+// Split a slash-separated path into its parent directory and base name
+func splitPath(path string) (parent string, name string) {
+	i := strings.LastIndex(path, "/")
+	if i < 0 {
+		return "", path
+	}
+	return path[:i], path[i+1:]
+}
+
+// Find the shared folder mount point that is path or one of its ancestors
+func findMount(user *User, path string) (mount string, err error) {
+	for {
+		fileKey, fileMacKey, err := getFileKeys(user, path)
+		if err == nil {
+			var fileNode FileNode
+			fileNodeId, err := getFileNodeId(user, path)
+			if err == nil {
+				fileNode, err = getFileNode(fileKey, fileMacKey, fileNodeId)
+			}
+			if err == nil && fileNode.IsDir {
+				return path, nil
+			}
+		}
+		if !strings.Contains(path, "/") {
+			return mount, errors.New("path is not inside a shared folder")
+		}
+		path, _ = splitPath(path)
+	}
+}
+
+// Private listings live under the user's own keys, i.e. "path/" + username. Shared
+// folder listings are encrypted under the folder key and found from the mount point
+func getDirectory(user *User, path string) (dir Directory, dirId uuid.UUID, dirKey []byte, dirMacKey []byte, err error) {
+	dirId = getUUID(path+"/", user.Username)
+
+	// The root listing is only stored once something is added to it, and accounts created
+	// before directories existed have none either
+	if _, ok := userlib.DatastoreGet(dirId); !ok && path == "" {
+		return dir, dirId, user.encKey, user.macKey, nil
+	}
+	dirEntry, err := symVerifyThenDec(user.encKey, user.macKey, dirId)
+	if err == nil {
+		err = json.Unmarshal(dirEntry, &dir)
+		if err != nil {
+			return dir, dirId, dirKey, dirMacKey, err
+		}
+		return dir, dirId, user.encKey, user.macKey, nil
+	}
+
+	// Otherwise walk down from the shared folder containing path
+	mount, err := findMount(user, path)
+	if err != nil {
+		return dir, dirId, dirKey, dirMacKey, errors.New("directory does not exist")
+	}
+	dirKey, dirMacKey, err = getFileKeys(user, mount)
+	if err != nil {
+		return dir, dirId, dirKey, dirMacKey, err
+	}
+	mountNodeId, err := getFileNodeId(user, mount)
+	if err != nil {
+		return dir, dirId, dirKey, dirMacKey, err
+	}
+	mountNode, err := getFileNode(dirKey, dirMacKey, mountNodeId)
+	if err != nil {
+		return dir, dirId, dirKey, dirMacKey, err
+	}
+	dirId = mountNode.FileHead
+	dirEntry, err = symVerifyThenDec(dirKey, dirMacKey, dirId)
+	if err != nil {
+		return dir, dirId, dirKey, dirMacKey, err
+	}
+	err = json.Unmarshal(dirEntry, &dir)
+	if err != nil {
+		return dir, dirId, dirKey, dirMacKey, err
+	}
+
+	if path == mount {
+		return dir, dirId, dirKey, dirMacKey, nil
+	}
+	for _, name := range strings.Split(path[len(mount)+1:], "/") {
+		found := false
+		for _, entry := range dir.Entries {
+			if entry.Name == name && entry.IsDir {
+				dirId = entry.Node
+				found = true
+				break
+			}
+		}
+		if !found {
+			return dir, dirId, dirKey, dirMacKey, errors.New("directory does not exist")
+		}
+
+		dir = Directory{}
+		dirEntry, err = symVerifyThenDec(dirKey, dirMacKey, dirId)
+		if err != nil {
+			return dir, dirId, dirKey, dirMacKey, err
+		}
+		err = json.Unmarshal(dirEntry, &dir)
+		if err != nil {
+			return dir, dirId, dirKey, dirMacKey, err
+		}
+	}
+	return dir, dirId, dirKey, dirMacKey, nil
+}
+
+// Add an entry for path to its parent's listing, failing if the parent is missing or the name is taken
+func addDirEntry(user *User, path string, entry DirEntry) (err error) {
+	if strings.HasSuffix(path, "/") {
+		return errors.New("path cannot end with a slash")
+	}
+	parent, name := splitPath(path)
+	dir, dirId, dirKey, dirMacKey, err := getDirectory(user, parent)
+	if err != nil {
+		return err
+	}
+	for _, existing := range dir.Entries {
+		if existing.Name == name {
+			return errors.New("name already exists in directory")
+		}
+	}
+	entry.Name = name
+	dir.Entries = append(dir.Entries, entry)
+	return symEncThenTag(dirKey, dirMacKey, dir, dirId)
+}
+
+// Remove path from its parent's listing
+func removeDirEntry(user *User, path string) (err error) {
+	parent, name := splitPath(path)
+	dir, dirId, dirKey, dirMacKey, err := getDirectory(user, parent)
+	if err != nil {
+		return err
+	}
+	for i, entry := range dir.Entries {
+		if entry.Name == name {
+			dir.Entries = append(dir.Entries[:i], dir.Entries[i+1:]...)
+			return symEncThenTag(dirKey, dirMacKey, dir, dirId)
+		}
+	}
+	return errors.New("name does not exist in directory")
+}
+
+// Move a file's per-user records to another path, keeping its place in the sharing tree.
+// Caller updates directory listings
+func moveFile(user *User, from string, to string) (err error) {
+	fileKey, fileMacKey, err := getFileKeys(user, from)
+	if err != nil {
+		return err
+	}
+	ownerName, err := getOwner(user, from)
+	if err != nil {
+		return err
+	}
+
+	// The file node stays where it is, so the sharer, recipients and pending invitations
+	// still find it, and only records its new path
+	fileNodeId, err := getFileNodeId(user, from)
+	if err != nil {
+		return err
+	}
+	fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	fileNode.Filename = to
+	err = symEncThenTag(fileKey, fileMacKey, fileNode, fileNodeId)
+	if err != nil {
+		return err
+	}
+	err = symEncThenTag(user.encKey, user.macKey, fileNodeId, getUUID(to+"node", user.Username))
+	if err != nil {
+		return err
+	}
+
+	// Key and owner records follow, the key is kept under the user's own keys
+	err = symEncThenTag(user.encKey, user.macKey, fileKey, getUUID(to+"key", user.Username))
+	if err != nil {
+		return err
+	}
+	err = symEncThenTag(user.encKey, user.macKey, ownerName, getUUID(to+"owner", user.Username))
+	if err != nil {
+		return err
+	}
+	writeKey, err := getWriteKey(user, from)
+	if err != nil {
+		return err
+	}
+	if writeKey != nil {
+		err = symEncThenTag(user.encKey, user.macKey, writeKey, getUUID(to+"writekey", user.Username))
+		if err != nil {
+			return err
+		}
+	}
+	userlib.DatastoreDelete(getUUID(from+"node", user.Username))
+	userlib.DatastoreDelete(getUUID(from+"key", user.Username))
+	userlib.DatastoreDelete(getUUID(from+"owner", user.Username))
+	userlib.DatastoreDelete(getUUID(from+"writekey", user.Username))
+
+	// Owner's drop boxes and grants don't say where they're kept, so they can move as is
+	for _, suffix := range []string{"drops", "grants"} {
+		if entry, ok := userlib.DatastoreGet(getUUID(from+suffix, user.Username)); ok {
+			userlib.DatastoreSet(getUUID(to+suffix, user.Username), entry)
+			userlib.DatastoreDelete(getUUID(from+suffix, user.Username))
+		}
+	}
+	return nil
+}
+
+// Head of a new, empty file. Files in a shared folder are charged to the folder's owner
+func newFileHead(user *User, filename string) (fileHead FileHead, err error) {
+	if strings.HasSuffix(filename, "/") {
+		return fileHead, errors.New("path cannot end with a slash")
+	}
+	parent, name := splitPath(filename)
+	dir, _, _, _, err := getDirectory(user, parent)
+	if err != nil {
+		return fileHead, err
+	}
+
+	// Nothing is written until the name is known to be free
+	for _, entry := range dir.Entries {
+		if entry.Name == name {
+			return fileHead, errors.New("name already exists in directory")
+		}
+	}
+
+	fileHead.Created = time.Now()
+	fileHead.Modified = fileHead.Created
+	fileHead.LastWriter = user.Username
+	fileHead.Version = 1
+	fileHead.MaxVersions = DefaultMaxVersions
+	fileHead.Dedup = DefaultDedup
+	fileHead.Owner = user.Username
+	fileHead.UsageKey = user.usageKey
+	if dir.Shared {
+		fileHead.Owner, err = getOwner(user, filename)
+		if err != nil {
+			return fileHead, err
+		}
+		fileHead.UsageKey = dir.UsageKey
+	}
+	return fileHead, nil
+}
+
+// Give a new file whose head is already stored its node and the user's records, then list
+// and index it. Files inside a shared folder are only reachable through the folder's listing
+func createFile(user *User, filename string, fileKey []byte, fileMacKey []byte, fileHeadId uuid.UUID) (err error) {
+	parent, _ := splitPath(filename)
+	dir, _, _, _, err := getDirectory(user, parent)
+	if err != nil {
+		return err
+	}
+
+	// Initialize file structure
+	var fileNode FileNode
+	fileNode.Username = user.Username
+	fileNode.Filename = filename
+	fileNode.Children = nil
+	fileNode.FileHead = fileHeadId
+	fileNodeId := uuid.New()
+	err = symEncThenTag(fileKey, fileMacKey, fileNode, fileNodeId)
+	if err != nil {
+		return err
+	}
+	var entry DirEntry
+	if dir.Shared {
+		entry.Node = fileNodeId
+		entry.Key = fileKey
+	} else {
+		err = symEncThenTag(user.encKey, user.macKey, fileNodeId, getUUID(filename+"node", user.Username))
+		if err != nil {
+			return err
+		}
+
+		// Store file key in datastore under getUUID(filename + "key", username)
+		fileKeyId := getUUID(filename+"key", user.Username)
+		err = symEncThenTag(user.encKey, user.macKey, fileKey, fileKeyId)
+		if err != nil {
+			return err
+		}
+
+		// Store username since current user is file owner
+		ownerId := getUUID(filename+"owner", user.Username)
+		err = symEncThenTag(user.encKey, user.macKey, user.Username, ownerId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only list and index the file once it's been written
+	err = addDirEntry(user, filename, entry)
+	if err != nil {
+		return err
+	}
+	return indexFile(user, filename, nil)
+}
+
+// UUID of a drop box's nth contribution
+func contributionId(dropKey []byte, n int) (id uuid.UUID, err error) {
+	hash, err := userlib.HashKDF(dropKey, []byte("contribution "+strconv.Itoa(n)))
+	if err != nil {
+		return id, err
+	}
+	return uuid.FromBytes(hash[:16])
+}
+
+// UUID of the note a drop box's recipient leaves when they decline it
+func declinedId(dropKey []byte) (id uuid.UUID, err error) {
+	hash, err := userlib.HashKDF(dropKey, []byte("declined"))
+	if err != nil {
+		return id, err
+	}
+	return uuid.FromBytes(hash[:16])
+}
+
+// UUID of the note the owner leaves when they close a drop box its recipient may still use
+func closedId(dropKey []byte) (id uuid.UUID, err error) {
+	hash, err := userlib.HashKDF(dropKey, []byte("closed"))
+	if err != nil {
+		return id, err
+	}
+	return uuid.FromBytes(hash[:16])
+}
+
+// Close a drop box for good. Its recipient's next append finds the note and fails, and
+// whatever they dropped that hasn't been collected is deleted
+func sealDropBox(user *User, drop DropBox) (err error) {
+	id, err := closedId(drop.Key)
+	if err != nil {
+		return err
+	}
+	err = asymEncThenTag(drop.Recipient, user.DSSignKey, drop.Invitation, id)
+	if err != nil {
+		return err
+	}
+	userlib.DatastoreDelete(drop.Invitation)
+	for n := drop.Next; ; n++ {
+		id, err := contributionId(drop.Key, n)
+		if err != nil {
+			return err
+		}
+		if _, ok := userlib.DatastoreGet(id); !ok {
+			return nil
+		}
+		userlib.DatastoreDelete(id)
+	}
+}
+
+// Close the drop boxes whose recipient declined them. Only the recipient could have signed
+// the note, and it has to name the invitation the drop box was handed out with
+func closeDeclined(user *User, filename string, drops []DropBox) (kept []DropBox, err error) {
+	for _, drop := range drops {
+		id, err := declinedId(drop.Key)
+		if err != nil {
+			return drops, err
+		}
+		if _, ok := userlib.DatastoreGet(id); !ok {
+			kept = append(kept, drop)
+			continue
+		}
+		var invitationPtr uuid.UUID
+		declinedEntry, err := asymVerifyThenDec(drop.Recipient, user.PKEDecKey, id)
+		if err == nil {
+			err = json.Unmarshal(declinedEntry, &invitationPtr)
+		}
+		if err != nil || invitationPtr != drop.Invitation {
+			kept = append(kept, drop)
+			continue
+		}
+		userlib.DatastoreDelete(id)
+		err = removeGrant(user, filename, drop.Recipient)
+		if err != nil {
+			return drops, err
+		}
+	}
+	if len(kept) == len(drops) {
+		return drops, nil
+	}
+	return kept, putDrops(user, filename, kept)
+}
+
+// Drop boxes of an owner's file, none if it was never shared append-only
+func getDrops(user *User, filename string) (drops []DropBox, err error) {
+	dropsId := getUUID(filename+"drops", user.Username)
+	if _, ok := userlib.DatastoreGet(dropsId); !ok {
+		return nil, nil
+	}
+
+	// Verify then decrypt drop boxes
+	dropsEntry, err := symVerifyThenDec(user.encKey, user.macKey, dropsId)
+	if err != nil {
+		return drops, err
+	}
+	err = json.Unmarshal(dropsEntry, &drops)
+	if err != nil {
+		return drops, err
+	}
+	return drops, nil
+}
+
+func putDrops(user *User, filename string, drops []DropBox) (err error) {
+	dropsId := getUUID(filename+"drops", user.Username)
+	if len(drops) == 0 {
+		userlib.DatastoreDelete(dropsId)
+		return nil
+	}
+	return symEncThenTag(user.encKey, user.macKey, drops, dropsId)
+}
+
+// Append every contribution waiting in an owner's drop boxes to the file, in each
+// recipient's order, then delete them. They're charged to the owner as they're collected.
+// A contribution that doesn't verify or is out of place closes its drop box, keeping what
+// came before it, rather than failing the owner's read
+func collectContributions(user *User, filename string) (err error) {
+	filename, err = resolveLink(user, filename)
+	if err != nil {
+		return err
+	}
+	drops, err := getDrops(user, filename)
+	if err != nil || len(drops) == 0 {
+		return err
+	}
+
+	// Looking the file up revokes expired grants, which can close drop boxes
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(user, filename)
+	if err != nil {
+		return err
+	}
+	drops, err = getDrops(user, filename)
+	if err != nil || len(drops) == 0 {
+		return err
+	}
+	drops, err = closeDeclined(user, filename, drops)
+	if err != nil || len(drops) == 0 {
+		return err
+	}
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	before := fileHead
+
+	var collected []uuid.UUID
+	var kept, bad []DropBox
+	for _, drop := range drops {
+		ok := true
+		for {
+			id, err := contributionId(drop.Key, drop.Next)
+			if err != nil {
+				return err
+			}
+			if _, exists := userlib.DatastoreGet(id); !exists {
+				break
+			}
+
+			// Verify then decrypt contribution, which only its recipient could have signed
+			var contribution Contribution
+			contributionEntry, err := asymVerifyThenDec(drop.Recipient, user.PKEDecKey, id)
+			if err == nil {
+				err = json.Unmarshal(contributionEntry, &contribution)
+			}
+			if err != nil || contribution.Index != drop.Next {
+				ok = false
+				break
+			}
+
+			err = appendChunks(fileKey, fileMacKey, writeKey, chunkKey(user, fileHead), &fileHead, contribution.Content)
+			if err != nil {
+				return err
+			}
+			fileHead.Modified = time.Now()
+			fileHead.LastWriter = drop.Recipient
+			drop.Next++
+			collected = append(collected, id)
+		}
+		if ok {
+			kept = append(kept, drop)
+		} else {
+			bad = append(bad, drop)
+		}
+	}
+	if len(collected) == 0 && len(bad) == 0 {
+		return nil
+	}
+
+	// Publish the contributions before forgetting where they were
+	if len(collected) > 0 {
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+		if err != nil {
+			return err
+		}
+		err = chargeUsage(user, before, fileHead)
+		if err != nil {
+			return err
+		}
+	}
+	err = putDrops(user, filename, kept)
+	if err != nil {
+		return err
+	}
+	for _, id := range collected {
+		userlib.DatastoreDelete(id)
+	}
+	for _, drop := range bad {
+		err = sealDropBox(user, drop)
+		if err != nil {
+			return err
+		}
+		err = removeGrant(user, filename, drop.Recipient)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write content to a recipient's drop box as contributions of at most ChunkSize bytes,
+// after any the owner hasn't collected yet
+func appendToDrop(user *User, filename string, content []byte) (err error) {
+	dropId := getUUID(filename+"drop", user.Username)
+	dropEntry, err := symVerifyThenDec(user.encKey, user.macKey, dropId)
+	if err != nil {
+		return err
+	}
+	var drop DropBox
+	err = json.Unmarshal(dropEntry, &drop)
+	if err != nil {
+		return err
+	}
+	err = checkSettings()
+	if err != nil {
+		return err
+	}
+
+	// Only the owner could have signed the note closing the drop box
+	closedNoteId, err := closedId(drop.Key)
+	if err != nil {
+		return err
+	}
+	if _, ok := userlib.DatastoreGet(closedNoteId); ok {
+		_, err = asymVerifyThenDec(drop.Owner, user.PKEDecKey, closedNoteId)
+		if err != nil {
+			return err
+		}
+		return errors.New("drop box has been closed by its owner")
+	}
+
+	for len(content) > 0 {
+		size := len(content)
+		if size > ChunkSize {
+			size = ChunkSize
+		}
+
+		// Another session may have written past this session's count
+		id, err := contributionId(drop.Key, drop.Next)
+		if err != nil {
+			return err
+		}
+		if _, ok := userlib.DatastoreGet(id); ok {
+			drop.Next++
+			continue
+		}
+
+		err = asymEncThenTag(drop.Owner, user.DSSignKey, Contribution{Index: drop.Next, Content: content[:size]}, id)
+		if err != nil {
+			return err
+		}
+		drop.Next++
+		content = content[size:]
+	}
+	return symEncThenTag(user.encKey, user.macKey, drop, dropId)
+}
+
+func getGrants(user *User, filename string) (grants []Grant, err error) {
+	grantsId := getUUID(filename+"grants", user.Username)
+	if _, ok := userlib.DatastoreGet(grantsId); !ok {
+		return nil, nil
+	}
+
+	// Verify then decrypt grants
+	grantsEntry, err := symVerifyThenDec(user.encKey, user.macKey, grantsId)
+	if err != nil {
+		return grants, err
+	}
+	err = json.Unmarshal(grantsEntry, &grants)
+	if err != nil {
+		return grants, err
+	}
+	return grants, nil
+}
+
+func putGrants(user *User, filename string, grants []Grant) (err error) {
+	grantsId := getUUID(filename+"grants", user.Username)
+	if len(grants) == 0 {
+		userlib.DatastoreDelete(grantsId)
+		return nil
+	}
+	return symEncThenTag(user.encKey, user.macKey, grants, grantsId)
+}
+
+// Record access that ends at expires, unless it's zero
+func addGrant(user *User, filename string, recipientUsername string, expires time.Time) (err error) {
+	if expires.IsZero() {
+		return nil
+	}
+	grants, err := getGrants(user, filename)
+	if err != nil {
+		return err
+	}
+	return putGrants(user, filename, append(grants, Grant{Recipient: recipientUsername, Expires: expires}))
+}
+
+func removeGrant(user *User, filename string, recipientUsername string) (err error) {
+	grants, err := getGrants(user, filename)
+	if err != nil || len(grants) == 0 {
+		return err
+	}
+	var kept []Grant
+	for _, grant := range grants {
+		if grant.Recipient != recipientUsername {
+			kept = append(kept, grant)
+		}
+	}
+	return putGrants(user, filename, kept)
+}
+
+// Revoke every grant of a file that has expired. RevokeAccess forgets each grant before
+// anything else, so the lookups it makes don't try again, and a grant is only gone once its
+// revocation has started. Recipients who are no longer shared with just lose their grant
+func expireGrants(user *User, filename string) (err error) {
+	grants, err := getGrants(user, filename)
+	if err != nil || len(grants) == 0 {
+		return err
+	}
+	var expired []string
+	now := time.Now()
+	for _, grant := range grants {
+		if now.After(grant.Expires) {
+			expired = append(expired, grant.Recipient)
+		}
+	}
+	for _, recipientUsername := range expired {
+		err = user.RevokeAccess(filename, recipientUsername)
+		if err != nil && err != errNotShared {
+			return err
+		}
+	}
+	return nil
+}
+
+// Inbox slots are numbered from 0 and filled in order. Slots before the recipient's start
+// have been emptied, and the start is also left unencrypted, signed by the recipient, so
+// senders needn't probe them
+func inboxSlot(username string, n int) uuid.UUID {
+	return getUUID("inbox "+strconv.Itoa(n), username)
+}
+
+func getInboxStart(user *User) (start int, err error) {
+	startId := getUUID("inbox", user.Username)
+	if _, ok := userlib.DatastoreGet(startId); !ok {
+		return 0, nil
+	}
+
+	// Verify then decrypt start
+	startEntry, err := symVerifyThenDec(user.encKey, user.macKey, startId)
+	if err != nil {
+		return start, err
+	}
+	err = json.Unmarshal(startEntry, &start)
+	if err != nil {
+		return start, err
+	}
+	return start, nil
+}
+
+// Only the recipient can sign a hint, so it never skips a slot they haven't cleared
+func putInboxHint(user *User, start int) (err error) {
+	hint := []byte(strconv.Itoa(start))
+	sig, err := userlib.DSSign(user.DSSignKey, hint)
+	if err != nil {
+		return err
+	}
+	userlib.DatastoreSet(getUUID("inbox-hint", user.Username), append(sig, hint...))
+	return nil
+}
+
+// Slot a sender starts looking for a free one from. Hints that don't verify are ignored,
+// and an old one replayed only costs probing
+func getInboxHint(recipientUsername string) (n int) {
+	hint, ok := userlib.DatastoreGet(getUUID("inbox-hint", recipientUsername))
+	if !ok || len(hint) <= 256 {
+		return 0
+	}
+	verifyKey, ok := userlib.KeystoreGet(getUUID("ds", recipientUsername).String())
+	if !ok || userlib.DSVerify(verifyKey, hint[256:], hint[:256]) != nil {
+		return 0
+	}
+	n, err := strconv.Atoi(string(hint[256:]))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// Leave a pointer to an invitation in the first free slot of the recipient's inbox
+func depositInvitation(user *User, recipientUsername string, invitationPtr uuid.UUID, filename string, expires time.Time) (err error) {
+	n := getInboxHint(recipientUsername)
+	for {
+		if _, ok := userlib.DatastoreGet(inboxSlot(recipientUsername, n)); !ok {
+			break
+		}
+		n++
+	}
+
+	_, name := splitPath(filename)
+	entry := InboxEntry{Sender: user.Username, Invitation: invitationPtr, Filename: name, Sent: time.Now(), Expires: expires}
+	return asymEncThenTag(recipientUsername, user.DSSignKey, entry, inboxSlot(recipientUsername, n))
+}
+
+// Path a deleted file's per-user records are kept under while it's in the trash
+func trashPath(id uuid.UUID) string {
+	return "trash:" + id.String()
+}
+
+func getTrash(user *User) (trash Trash, err error) {
+	trashId := getUUID("trash", user.Username)
+	if _, ok := userlib.DatastoreGet(trashId); !ok {
+		return trash, nil
+	}
+
+	// Verify then decrypt trash
+	trashEntry, err := symVerifyThenDec(user.encKey, user.macKey, trashId)
+	if err != nil {
+		return trash, err
+	}
+	err = json.Unmarshal(trashEntry, &trash)
+	if err != nil {
+		return trash, err
+	}
+	return trash, nil
+}
+
+// Permanently delete a trashed file. An owner's file is deleted outright, while a recipient
+// only drops their records and leaves their node so revocation still reaches anyone below it
+func purgeTrashEntry(user *User, entry TrashEntry) (err error) {
+	if entry.Key != nil {
+		// Shared folder files have nothing but their node and head
+		fileMacKey, err := userlib.HashKDF(entry.Key, []byte("mac-key"))
+		if err != nil {
+			return err
+		}
+		fileNode, err := getFileNode(entry.Key, fileMacKey, entry.Node)
+		if err != nil {
+			return err
+		}
+		err = deleteFileData(user, entry.Key, fileMacKey, nil, fileNode.FileHead)
+		if err != nil {
+			return err
+		}
+		userlib.DatastoreDelete(entry.Node)
+		return nil
+	}
+
+	path := trashPath(entry.Id)
+	ownerName, err := getOwner(user, path)
+	if err != nil {
+		return err
+	}
+	if ownerName == user.Username {
+		fileKey, fileMacKey, err := getFileKeys(user, path)
+		if err != nil {
+			return err
+		}
+		writeKey, err := getWriteKey(user, path)
+		if err != nil {
+			return err
+		}
+		fileNodeId, err := getFileNodeId(user, path)
+		if err != nil {
+			return err
+		}
+		fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
+		if err != nil {
+			return err
+		}
+		fileHeadId, err := getFileHeadId(fileKey, fileMacKey, fileNode)
+		if err != nil {
+			return err
+		}
+		err = deleteFileData(user, fileKey, fileMacKey, writeKey, fileHeadId)
+		if err != nil {
+			return err
+		}
+		userlib.DatastoreDelete(fileNodeId)
+	}
+	userlib.DatastoreDelete(getUUID(path+"node", user.Username))
+	userlib.DatastoreDelete(getUUID(path+"key", user.Username))
+	userlib.DatastoreDelete(getUUID(path+"owner", user.Username))
+	userlib.DatastoreDelete(getUUID(path+"writekey", user.Username))
+	userlib.DatastoreDelete(getUUID(path+"drops", user.Username))
+	userlib.DatastoreDelete(getUUID(path+"grants", user.Username))
+	return nil
+}
+
+// Usage charged for a file, i.e. every content node in its chain, versions and retired chain
+func fileUsage(fileHead FileHead) Usage {
+	return Usage{
+		Bytes:   fileHead.Size + fileHead.VersionBytes + fileHead.RetiredSize,
+		Objects: fileHead.NumNodes + fileHead.VersionNodes + fileHead.RetiredNodes,
+	}
+}
+
+// Read a user's usage record, checking it was signed by them
+func getUsage(owner string, usageKey []byte) (usage Usage, usageId uuid.UUID, err error) {
+	usageId = getUUID("usage", owner)
+	if _, ok := userlib.DatastoreGet(usageId); !ok {
+		return usage, usageId, nil
+	}
+	verifyKey, ok := userlib.KeystoreGet(getUUID("ds", owner).String())
+	if !ok {
+		return usage, usageId, errors.New("could not find user's DSVerifyKey in keystore")
+	}
+
+	// Verify then decrypt usage record
+	dataStoreEntry, _ := userlib.DatastoreGet(usageId)
+	if len(dataStoreEntry) < 256+userlib.AESBlockSizeBytes {
+		return usage, usageId, errors.New("tampering has occurred")
+	}
+	err = userlib.DSVerify(verifyKey, dataStoreEntry[256:], dataStoreEntry[:256])
+	if err != nil {
+		return usage, usageId, errors.New("signature does not match, content has been changed")
+	}
+	err = json.Unmarshal(userlib.SymDec(usageKey[:16], dataStoreEntry[256:]), &usage)
+	if err != nil {
+		return usage, usageId, err
+	}
+	return usage, usageId, nil
+}
+
+// The usage record is signed by its owner, so the key to it in every FileHead only lets
+// others read it
+func putUsage(user *User, usage Usage) (err error) {
+	marshalUsage, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	encUsage := userlib.SymEnc(user.usageKey[:16], userlib.RandomBytes(16), marshalUsage)
+	sig, err := userlib.DSSign(user.DSSignKey, encUsage)
+	if err != nil {
+		return err
+	}
+	userlib.DatastoreSet(getUUID("usage", user.Username), append(sig, encUsage...))
+	return nil
+}
+
+// Charge a file's owner for the change between two of its heads. Files without a usage key
+// predate accounting and are never charged. Only the owner can sign their usage record, so
+// changes made by anyone else are picked up the next time the owner recounts
+func chargeUsage(user *User, before FileHead, after FileHead) (err error) {
+	if after.UsageKey == nil || after.Owner != user.Username {
+		return nil
+	}
+	usage, _, err := getUsage(after.Owner, after.UsageKey)
+	if err != nil {
+		return err
+	}
+	usage.Bytes += fileUsage(after).Bytes - fileUsage(before).Bytes
+	usage.Objects += fileUsage(after).Objects - fileUsage(before).Objects
+	return putUsage(user, usage)
+}
+
+// Count the usage of every file the user owns from the files' own heads, including trashed
+// ones, and store it as their usage record
+func recountUsage(user *User) (usage Usage, err error) {
+	counted := make(map[uuid.UUID]bool)
+	err = countTree(user, "", counted, &usage)
+	if err != nil {
+		return usage, err
+	}
+	trash, err := getTrash(user)
+	if err != nil {
+		return usage, err
+	}
+	for _, entry := range trash.Entries {
+		if entry.Key != nil {
+			fileMacKey, err := userlib.HashKDF(entry.Key, []byte("mac-key"))
+			if err != nil {
+				return usage, err
+			}
+			countFile(user, entry.Key, fileMacKey, nil, entry.Node, counted, &usage)
+			continue
+		}
+		path := trashPath(entry.Id)
+		fileKey, fileMacKey, err := getFileKeys(user, path)
+		if err != nil {
+			continue
+		}
+		fileNodeId, err := getFileNodeId(user, path)
+		if err != nil {
+			return usage, err
+		}
+		writeKey, err := getWriteKey(user, path)
+		if err != nil {
+			return usage, err
+		}
+		countFile(user, fileKey, fileMacKey, writeKey, fileNodeId, counted, &usage)
+	}
+	return usage, putUsage(user, usage)
+}
+
+// Add every file the user owns under a directory to usage. Links, files shared with the user
+// and anything they can no longer open are left out
+func countTree(user *User, path string, counted map[uuid.UUID]bool, usage *Usage) (err error) {
+	dir, _, _, _, err := getDirectory(user, path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir.Entries {
+		child := entry.Name
+		if path != "" {
+			child = path + "/" + entry.Name
+		}
+		if entry.IsDir {
+			// Shared folders the user was revoked from can't be opened any more
+			if _, mounted := userlib.DatastoreGet(getUUID(child+"key", user.Username)); mounted {
+				_, _, _, _, err := getDirectory(user, child)
+				if err != nil {
+					continue
+				}
+			}
+			err = countTree(user, child, counted, usage)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Files in a shared folder are reached through its listing
+		fileNodeId, fileKey := entry.Node, entry.Key
+		var fileMacKey, writeKey []byte
+		if fileKey != nil {
+			fileMacKey, err = userlib.HashKDF(fileKey, []byte("mac-key"))
+			if err != nil {
+				return err
+			}
+		} else {
+			fileKey, fileMacKey, err = getFileKeys(user, child)
+			if err != nil {
+				continue
+			}
+			fileNodeId, err = getFileNodeId(user, child)
+			if err != nil {
+				return err
+			}
+			writeKey, err = getWriteKey(user, child)
+			if err != nil {
+				return err
+			}
+		}
+		countFile(user, fileKey, fileMacKey, writeKey, fileNodeId, counted, usage)
+	}
+	return nil
+}
+
+// Add a file to usage if the user owns it and it hasn't been counted under another name
+func countFile(user *User, fileKey []byte, fileMacKey []byte, writeKey []byte, fileNodeId uuid.UUID, counted map[uuid.UUID]bool, usage *Usage) {
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil || counted[fileHeadId] || fileHead.Owner != user.Username || fileHead.UsageKey == nil {
+		return
+	}
+	counted[fileHeadId] = true
+	usage.Bytes += fileUsage(fileHead).Bytes
+	usage.Objects += fileUsage(fileHead).Objects
+}
+
+// Fail before writing size bytes to a file if they would put its owner over quota. Checked
+// against what's being written, before anything overwritten is freed. Usage counts a file's
+// logical bytes, so size is charged in full however well it compresses or deduplicates, and
+// nodes are estimated as whole chunks
+func checkQuota(user *User, fileHead FileHead, size int) (err error) {
+	err = checkSettings()
+	if err != nil {
+		return err
+	}
+	if fileHead.UsageKey == nil || (StorageQuota == 0 && ObjectQuota == 0) {
+		return nil
+	}
+
+	// Checked against the stored record, which only misses writes by others since the owner
+	// last recounted. Owners without one yet recount to start it
+	usage, usageId, err := getUsage(fileHead.Owner, fileHead.UsageKey)
+	if err != nil {
+		return err
+	}
+	if _, ok := userlib.DatastoreGet(usageId); !ok && fileHead.Owner == user.Username {
+		usage, err = recountUsage(user)
+		if err != nil {
+			return err
+		}
+	}
+	nodes := (size + ChunkSize - 1) / ChunkSize
+	if nodes == 0 {
+		nodes = 1
+	}
+	if StorageQuota > 0 && usage.Bytes+size > StorageQuota {
+		return ErrQuotaExceeded
+	}
+	if ObjectQuota > 0 && usage.Objects+nodes > ObjectQuota {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+func getSearchIndex(user *User) (index SearchIndex, err error) {
+	indexId := getUUID("search", user.Username)
+	if _, ok := userlib.DatastoreGet(indexId); !ok {
+		return index, nil
+	}
+
+	// Verify then decrypt search index
+	indexEntry, err := symVerifyThenDec(user.encKey, user.macKey, indexId)
+	if err != nil {
+		return index, err
+	}
+	err = json.Unmarshal(indexEntry, &index)
+	if err != nil {
+		return index, err
+	}
+	return index, nil
+}
+
+// Add or replace a file's entry in the user's search index
+func indexFile(user *User, name string, labels []string) (err error) {
+	index, err := getSearchIndex(user)
+	if err != nil {
+		return err
+	}
+	for i, entry := range index.Entries {
+		if entry.Name == name {
+			index.Entries = append(index.Entries[:i], index.Entries[i+1:]...)
+			break
+		}
+	}
+	index.Entries = append(index.Entries, SearchEntry{Name: name, Labels: labels})
+	return symEncThenTag(user.encKey, user.macKey, index, getUUID("search", user.Username))
+}
+
+func unindexFile(user *User, name string) (err error) {
+	index, err := getSearchIndex(user)
+	if err != nil {
+		return err
+	}
+	for i, entry := range index.Entries {
+		if entry.Name == name {
+			index.Entries = append(index.Entries[:i], index.Entries[i+1:]...)
+			return symEncThenTag(user.encKey, user.macKey, index, getUUID("search", user.Username))
+		}
+	}
+	return nil
+}
+
+// Add every file under a directory to index. Anything the user can no longer open, e.g.
+// after being revoked, is left out
+func indexTree(user *User, path string, index *SearchIndex) (err error) {
+	dir, _, _, _, err := getDirectory(user, path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir.Entries {
+		child := entry.Name
+		if path != "" {
+			child = path + "/" + entry.Name
+		}
+		if entry.IsDir {
+			// Shared folders the user was revoked from can't be opened any more
+			if _, mounted := userlib.DatastoreGet(getUUID(child+"key", user.Username)); mounted {
+				_, _, _, _, err := getDirectory(user, child)
+				if err != nil {
+					continue
+				}
+			}
+			err = indexTree(user, child, index)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		labels, err := fileLabels(user, child)
+		if err != nil {
+			continue
+		}
+		index.Entries = append(index.Entries, SearchEntry{Name: child, Labels: labels})
+	}
+	return nil
+}
+
+func fileLabels(user *User, filename string) (labels []string, err error) {
+	attrs, err := user.ListAttrs(filename)
+	if err != nil {
+		return nil, err
+	}
+	return splitLabels(attrs[AttrLabels]), nil
+}
+
+// Labels are comma-separated, ignoring spaces around them and empty ones
+func splitLabels(value string) (labels []string) {
+	for _, label := range strings.Split(value, ",") {
+		label = strings.TrimSpace(label)
+		if label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return labels
+}
+
+// Purge trashed files past the retention period, or every one of them, then store the trash
+func purgeTrash(user *User, trash Trash, all bool) (kept Trash, err error) {
+	err = checkSettings()
+	if err != nil {
+		return trash, err
+	}
+	kept.Entries = []TrashEntry{}
+	for _, entry := range trash.Entries {
+		if all || time.Since(entry.Deleted) >= TrashRetention {
+			err = purgeTrashEntry(user, entry)
+			if err != nil {
+				return kept, err
+			}
+		} else {
+			kept.Entries = append(kept.Entries, entry)
+		}
+	}
+	err = symEncThenTag(user.encKey, user.macKey, kept, getUUID("trash", user.Username))
+	if err != nil {
+		return kept, err
+	}
+	return kept, nil
+}
+
+// Purge trashed files past the retention period, only rewriting the trash if any are
+func expireTrash(user *User) (err error) {
+	trash, err := getTrash(user)
+	if err != nil {
+		return err
+	}
+	for _, entry := range trash.Entries {
+		if time.Since(entry.Deleted) >= TrashRetention {
+			_, err = purgeTrash(user, trash, false)
+			return err
+		}
+	}
+	return nil
+}
+
+// Turn a private directory into a shared folder. The mount point gets a folder node, key
+// and owner record just like a file, and its listings move under the folder key
+func shareDirectory(user *User, path string) (err error) {
+	if path == "" {
+		return errors.New("cannot share root directory")
+	}
+
+	// Generate folder key and folder MAC key
+	folderKey := userlib.RandomBytes(16)
+	folderMacKey, err := userlib.HashKDF(folderKey, []byte("mac-key"))
+	if err != nil {
+		return err
+	}
+
+	var cleanup []uuid.UUID
+	listingId, err := convertDirectory(user, path, folderKey, folderMacKey, &cleanup)
+	if err != nil {
+		return err
+	}
+
+	// Store folder node under the mount point
+	var folderNode FileNode
+	folderNode.Username = user.Username
+	folderNode.Filename = path
+	folderNode.FileHead = listingId
+	folderNode.IsDir = true
+	folderNodeId, err := newFileNodeId(user, path)
+	if err != nil {
+		return err
+	}
+	err = symEncThenTag(folderKey, folderMacKey, folderNode, folderNodeId)
+	if err != nil {
+		return err
+	}
+
+	// Store folder key and owner like a file's
+	err = symEncThenTag(user.encKey, user.macKey, folderKey, getUUID(path+"key", user.Username))
+	if err != nil {
+		return err
+	}
+	err = symEncThenTag(user.encKey, user.macKey, user.Username, getUUID(path+"owner", user.Username))
+	if err != nil {
+		return err
+	}
+
+	// Private listings and file records are only removed once everything is copied
+	for _, id := range cleanup {
+		userlib.DatastoreDelete(id)
+	}
+
+	return nil
+}
+
+// Copy a private directory tree into shared listings under the folder key. Files keep
+// their nodes but lose their per-user records, which are added to cleanup along with
+// the private listings
+func convertDirectory(user *User, path string, folderKey []byte, folderMacKey []byte, cleanup *[]uuid.UUID) (listingId uuid.UUID, err error) {
+	dir, dirId, _, _, err := getDirectory(user, path)
+	if err != nil {
+		return listingId, err
+	}
+	if dir.Shared {
+		return listingId, errors.New("cannot share a folder containing a shared folder")
+	}
+	*cleanup = append(*cleanup, dirId)
+
+	for i, entry := range dir.Entries {
+		child := path + "/" + entry.Name
+		if entry.IsDir {
+			dir.Entries[i].Node, err = convertDirectory(user, child, folderKey, folderMacKey, cleanup)
+			if err != nil {
+				return listingId, err
+			}
+			continue
+		}
+
+		// Only the user's own, unshared and unlinked files can move into a shared folder
+		target, err := resolveLink(user, child)
+		if err != nil {
+			return listingId, err
+		}
+		links, err := getLinks(user, child)
+		if err != nil {
+			return listingId, err
+		}
+		if target != child || len(links) != 0 {
+			return listingId, errors.New("cannot share a folder containing linked files")
+		}
+		ownerName, err := getOwner(user, child)
+		if err != nil {
+			return listingId, err
+		}
+		fileKey, fileMacKey, err := getFileKeys(user, child)
+		if err != nil {
+			return listingId, err
+		}
+		fileNodeId, err := getFileNodeId(user, child)
+		if err != nil {
+			return listingId, err
+		}
+		fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
+		if err != nil {
+			return listingId, err
+		}
+		_, signed := writerVerifyKey(fileKey)
+		if ownerName != user.Username || len(fileNode.ChildrenNames) != 0 || signed {
+			return listingId, errors.New("cannot share a folder containing shared files")
+		}
+
+		dir.Entries[i].Node = fileNodeId
+		dir.Entries[i].Key = fileKey
+		*cleanup = append(*cleanup, getUUID(child+"node", user.Username), getUUID(child+"key", user.Username), getUUID(child+"owner", user.Username))
+	}
+
+	dir.Shared = true
+	dir.UsageKey = user.usageKey
+	listingId = uuid.New()
+	err = symEncThenTag(folderKey, folderMacKey, dir, listingId)
+	if err != nil {
+		return listingId, err
+	}
+	return listingId, nil
+}
+
+// Copy a file's content chain to fresh nodes under a new file key, deleting the old chain
+func rekeyFile(fileKey []byte, fileMacKey []byte, writeKey []byte, newFileKey []byte, newFileMacKey []byte, newWriteKey []byte, dedupKey []byte, fileHeadId uuid.UUID) (newFileHeadId uuid.UUID, err error) {
+	// Verify then decrypt file head
+	fileHead, err := loadFileHead(fileKey, fileMacKey, writeKey, fileHeadId)
+	if err != nil {
+		return newFileHeadId, err
+	}
+
+	// Verify then decrypt first content node
+	contentNodeId := fileHead.FirstNode
+	contentNodeEntry, err := fileVerifyThenDec(fileKey, fileMacKey, contentNodeId)
+	if err != nil {
+		return newFileHeadId, err
+	}
+	var contentNode ContentNode
+	err = json.Unmarshal(contentNodeEntry, &contentNode)
+	if err != nil {
+		return newFileHeadId, err
+	}
+
+	// Setup new file head (keeping metadata) and start of content node chain
+	newFileHead := fileHead
+	newFileHeadId = uuid.New()
+	newFileHead.FirstNode = uuid.New()
+	newFileHead.IndexPages = nil
+	newFileHead.PageOffsets = nil
+	offset := 0
+
+	var newContentNode ContentNode
+	newContentNode.NextNode = uuid.New()
+
+	// Recursively delete content nodes in linked list while copying to new list
+	newContentNodeId := newFileHead.FirstNode
+	for contentNode.NextNode != uuid.Nil {
+		// Get content from old content node then store in new one under a fresh key
+		content, err := getContents(contentNode)
+		if err != nil {
+			return newFileHeadId, err
+		}
+		err = putContents(&newContentNode, content, &newFileHead, dedupKey)
+		if err != nil {
+			return newFileHeadId, err
+		}
+
+		// Encrypt then tag new content node and index it
+		err = fileEncThenTag(newFileKey, newFileMacKey, newWriteKey, newContentNode, newContentNodeId)
+		if err != nil {
+			return newFileHeadId, err
+		}
+		err = addToIndex(newFileKey, newFileMacKey, newWriteKey, &newFileHead, newContentNodeId, offset)
+		if err != nil {
+			return newFileHeadId, err
+		}
+		offset += len(content)
+
+		// Update vars for next iteration
+		newContentNodeId = newContentNode.NextNode
+		newContentNode.NextNode = uuid.New()
+
+		// Verify then decrypt next node in old chain, into a fresh struct so its slices
+		// don't overwrite the current node's
+		nextNodeEntry, err := fileVerifyThenDec(fileKey, fileMacKey, contentNode.NextNode)
+		if err != nil {
+			return newFileHeadId, err
+		}
+		var nextNode ContentNode
+		err = json.Unmarshal(nextNodeEntry, &nextNode)
+		if err != nil {
+			return newFileHeadId, err
+		}
+
+		// Delete current node then update contentNode, copies keep any contents they share
+		err = releaseContents(contentNode)
+		if err != nil {
+			return newFileHeadId, err
+		}
+		userlib.DatastoreDelete(contentNodeId)
+		contentNodeId = contentNode.NextNode
+		contentNode = nextNode
+	}
+
+	// Get content from old content node then store in new one under a fresh key
+	content, err := getContents(contentNode)
+	if err != nil {
+		return newFileHeadId, err
+	}
+	err = putContents(&newContentNode, content, &newFileHead, dedupKey)
+	if err != nil {
+		return newFileHeadId, err
+	}
+
+	// Encrypt then tag last new content node and index it
+	newContentNode.NextNode = uuid.Nil
+	err = fileEncThenTag(newFileKey, newFileMacKey, newWriteKey, newContentNode, newContentNodeId)
+	if err != nil {
+		return newFileHeadId, err
+	}
+	err = addToIndex(newFileKey, newFileMacKey, newWriteKey, &newFileHead, newContentNodeId, offset)
+	if err != nil {
+		return newFileHeadId, err
+	}
+	err = releaseContents(contentNode)
+	if err != nil {
+		return newFileHeadId, err
+	}
+	userlib.DatastoreDelete(contentNodeId)
+	deleteIndex(&fileHead)
+	err = deleteRetired(fileKey, fileMacKey, &fileHead)
+	if err != nil {
+		return newFileHeadId, err
+	}
+	newFileHead.RetiredNode = uuid.Nil
+	newFileHead.RetiredPages = nil
+	newFileHead.RetiredSize = 0
+	newFileHead.RetiredNodes = 0
+
+	// Move past versions under the new key too
+	err = rekeyVersions(fileKey, fileMacKey, newFileKey, newFileMacKey, newWriteKey, &newFileHead)
+	if err != nil {
+		return newFileHeadId, err
+	}
+
+	// Encrypt then tag new file head, delete old one
+	newFileHead.LastNode = newContentNodeId
+	err = fileEncThenTag(newFileKey, newFileMacKey, newWriteKey, newFileHead, newFileHeadId)
+	if err != nil {
+		return newFileHeadId, err
+	}
+	userlib.DatastoreDelete(fileHeadId)
+
+	return newFileHeadId, nil
+}
+
+// Move a shared folder's listings under a new folder key. Every file inside also gets a
+// new file key, so a revoked member can't follow changes to any of them
+func rekeyDirectory(folderKey []byte, newFolderKey []byte, listingId uuid.UUID) (newListingId uuid.UUID, err error) {
+	folderMacKey, err := userlib.HashKDF(folderKey, []byte("mac-key"))
+	if err != nil {
+		return newListingId, err
+	}
+	newFolderMacKey, err := userlib.HashKDF(newFolderKey, []byte("mac-key"))
+	if err != nil {
+		return newListingId, err
+	}
+
+	// Verify then decrypt listing
+	dirEntry, err := symVerifyThenDec(folderKey, folderMacKey, listingId)
+	if err != nil {
+		return newListingId, err
+	}
+	var dir Directory
+	err = json.Unmarshal(dirEntry, &dir)
+	if err != nil {
+		return newListingId, err
+	}
+
+	for i, entry := range dir.Entries {
+		if entry.IsDir {
+			dir.Entries[i].Node, err = rekeyDirectory(folderKey, newFolderKey, entry.Node)
+			if err != nil {
+				return newListingId, err
+			}
+			continue
+		}
+
+		// Copy file under a new key and move its node somewhere the revoked member can't find
+		fileMacKey, err := userlib.HashKDF(entry.Key, []byte("mac-key"))
+		if err != nil {
+			return newListingId, err
+		}
+		fileNode, err := getFileNode(entry.Key, fileMacKey, entry.Node)
+		if err != nil {
+			return newListingId, err
+		}
+		newFileKey := userlib.RandomBytes(16)
+		newFileMacKey, err := userlib.HashKDF(newFileKey, []byte("mac-key"))
+		if err != nil {
+			return newListingId, err
+		}
+		fileNode.FileHead, err = rekeyFile(entry.Key, fileMacKey, nil, newFileKey, newFileMacKey, nil, nil, fileNode.FileHead)
+		if err != nil {
+			return newListingId, err
+		}
+		newFileNodeId := uuid.New()
+		err = symEncThenTag(newFileKey, newFileMacKey, fileNode, newFileNodeId)
+		if err != nil {
+			return newListingId, err
+		}
+		userlib.DatastoreDelete(entry.Node)
+		dir.Entries[i].Node = newFileNodeId
+		dir.Entries[i].Key = newFileKey
+	}
+
+	// Encrypt then tag listing in its new location, delete old one
+	newListingId = uuid.New()
+	err = symEncThenTag(newFolderKey, newFolderMacKey, dir, newListingId)
+	if err != nil {
+		return newListingId, err
+	}
+	userlib.DatastoreDelete(listingId)
+
+	return newListingId, nil
+}
+
+// Copy a file or shared folder under a new key, which for a shared folder means every file
+// in it, then give everyone still in its tree the new key. A signed file, or one about to
+// be, is signed by a new writer key from then on, which goes to the same nodes as before.
+// When a file is first signed that's every node in its tree
+func rekeyShare(user *User, fileNodeId uuid.UUID, fileNode FileNode, fileKey []byte, fileMacKey []byte, writeKey []byte, signed bool) (err error) {
+	newFileKey := userlib.RandomBytes(16)
+	newFileMacKey, err := userlib.HashKDF(newFileKey, []byte("mac-key"))
+	if err != nil {
+		return err
+	}
+	var newWriteKey []byte
+	if signed {
+		newWriteKey, err = setupSigning(user, newFileKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	var newFileHeadId uuid.UUID
+	if fileNode.IsDir {
+		newFileHeadId, err = rekeyDirectory(fileKey, newFileKey, fileNode.FileHead)
+	} else {
+		fileHeadId, err := getFileHeadId(fileKey, fileMacKey, fileNode)
+		if err != nil {
+			return err
+		}
+		fileHead, err := loadFileHead(fileKey, fileMacKey, writeKey, fileHeadId)
+		if err != nil {
+			return err
+		}
+		newFileHeadId, err = rekeyFile(fileKey, fileMacKey, writeKey, newFileKey, newFileMacKey, newWriteKey, chunkKey(user, fileHead), fileHeadId)
+		if err != nil {
+			return err
+		}
+
+		// Re-keying deletes the retired chain
+		newFileHead, err := loadFileHead(newFileKey, newFileMacKey, newWriteKey, newFileHeadId)
+		if err != nil {
+			return err
+		}
+		err = chargeUsage(user, fileHead, newFileHead)
+	}
+	if err != nil {
+		return err
+	}
+
+	var writers map[uuid.UUID]bool
+	if _, wasSigned := writerVerifyKey(fileKey); wasSigned {
+		oldWriters, err := getWriters(fileKey, fileMacKey)
+		if err != nil {
+			return err
+		}
+		writers = make(map[uuid.UUID]bool)
+		for _, id := range oldWriters.Nodes {
+			writers[id] = true
+		}
+	}
+	var kept []uuid.UUID
+	err = cleanFileTree(fileKey, newFileKey, newWriteKey, writers, &kept, fileNodeId, newFileHeadId, user.DSSignKey)
+	if err != nil {
+		return err
+	}
+	if !signed {
+		return nil
+	}
+	return putWriters(newFileKey, newFileMacKey, newWriteKey, FileWriters{Head: newFileHeadId, Nodes: kept})
+}
+
+// Give every node left in the tree the new file head and key, and writers of a signed file
+// its new write key. Nodes are writers if they're in writers, or always if it's nil, and
+// are added to kept when given the write key
+func cleanFileTree(fileKey []byte, newFileKey []byte, writeKey []byte, writers map[uuid.UUID]bool, kept *[]uuid.UUID, fileNodeId uuid.UUID, head uuid.UUID, sign userlib.DSSignKey) (err error) {
+	// Derive MAC keys
+	fileMacKey, err := userlib.HashKDF(fileKey, []byte("mac-key"))
+	if err != nil {
+		return err
+	}
+	newFileMacKey, err := userlib.HashKDF(newFileKey, []byte("mac-key"))
+	if err != nil {
+		return err
+	}
+
+	// Get file node
+	fileNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	var fileNode FileNode
+	err = json.Unmarshal(fileNodeEntry, &fileNode)
+	if err != nil {
+		return err
+	}
+
+	newChildren := fileNode.Children
+	for _, id := range fileNode.Children {
+		// Verify then decrypt child file node
+		childFileNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, id)
+		if err != nil {
+			return err
+		}
+		var childFileNode FileNode
+		err = json.Unmarshal(childFileNodeEntry, &childFileNode)
+		if err != nil {
+			return err
+		}
+
+		cleanFileTree(fileKey, newFileKey, writeKey, writers, kept, id, head, sign)
+	}
+	// Update values for file node
+	fileNode.Children = newChildren
+	fileNode.FileHead = head
+	err = symEncThenTag(newFileKey, newFileMacKey, fileNode, fileNodeId)
+	if err != nil {
+		return err
+	}
+
+	// Store new file key for current user
+	fileKeyId := getUUID(fileNode.Filename+"key", fileNode.Username)
+	err = asymEncThenTag(fileNode.Username, sign, newFileKey, fileKeyId)
+	if err != nil {
+		return err
+	}
+	if writeKey != nil && (writers == nil || writers[fileNodeId]) {
+		*kept = append(*kept, fileNodeId)
+		writeKeyId := getUUID(fileNode.Filename+"writekey", fileNode.Username)
+		err = asymEncThenTag(fileNode.Username, sign, writeKey, writeKeyId)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func InitUser(username string, password string) (userdataptr *User, err error) {
+	if username == "" {
+		return userdataptr, errors.New("invalid username")
+	}
+
+	var userdata User
+	userdata.Username = username
+
+	// Get sign and verify keys for digital signatures
+	DSSignKey, DSVerifyKey, err := userlib.DSKeyGen()
+	if err != nil {
+		return &userdata, err
+	}
+
+	// Add sign key to struct, verify key to Keystore
+	userdata.DSSignKey = DSSignKey
+	id := getUUID("ds", username)
+	err = userlib.KeystoreSet(id.String(), DSVerifyKey)
+	if err != nil {
+		return &userdata, err
+	}
+
+	// Get public and private keys for enc/dec
+	PKEEncKey, PKEDecKey, err := userlib.PKEKeyGen()
+	if err != nil {
+		return &userdata, err
+	}
+
+	// Add public key to keystore, private key to struct
+	userdata.PKEDecKey = PKEDecKey
+	id = getUUID("pke", username)
+	err = userlib.KeystoreSet(id.String(), PKEEncKey)
+	if err != nil {
+		return &userdata, err
+	}
+
+	// Generate root key using salt and password
+	salt := userlib.RandomBytes(32)
+	rootKey := userlib.Argon2Key([]byte(password), salt, 16)
+
+	// Derive encryption/authentication keys
+	encKey, err := userlib.HashKDF(rootKey, []byte("enc-key"))
+	if err != nil {
+		return &userdata, err
+	}
+	macKey, err := userlib.HashKDF(rootKey, []byte("mac-key"))
+	if err != nil {
+		return &userdata, err
+	}
+
+	// Store salt in datastore
+	id = getUUID("salt", username)
+	userlib.DatastoreSet(id, salt)
+
+	// Tag user struct and store in datastore
+	id = getUUID("struct", username)
+	err = symEncThenTag(encKey, macKey, userdata, id)
+	if err != nil {
+		return &userdata, err
+	}
+
+	usageKey, err := userlib.HashKDF(rootKey, []byte("usage-key"))
+	if err != nil {
+		return &userdata, err
+	}
+	dedupKey, err := userlib.HashKDF(rootKey, []byte("dedup-key"))
+	if err != nil {
+		return &userdata, err
+	}
+
+	// Add derived keys to user struct
+	userdata.encKey = encKey
+	userdata.macKey = macKey
+	userdata.usageKey = usageKey
+	userdata.dedupKey = dedupKey[:16]
+
+	return &userdata, nil
+}
+
+func GetUser(username string, password string) (userdataptr *User, err error) {
+	var userdata User
+	userdataptr = &userdata
+
+	// Get user's salt from datastore
+	id := getUUID("salt", username)
+	salt, ok := userlib.DatastoreGet(id)
+	if !ok {
+		return &userdata, errors.New("user salt doesn't exist")
+	}
+
+	// Get user's struct from datastore
+	id = getUUID("struct", username)
+
+	// Get root key and derive enc/mac keys
+	rootKey := userlib.Argon2Key([]byte(password), salt, 16)
+
+	encKey, err := userlib.HashKDF(rootKey, []byte("enc-key"))
+	if err != nil {
+		return &userdata, err
+	}
+	macKey, err := userlib.HashKDF(rootKey, []byte("mac-key"))
+	if err != nil {
+		return &userdata, err
+	}
+
+	// Verify/decrypt user struct then cast to User
+	userdataEntry, err := symVerifyThenDec(encKey, macKey, id)
+	if err != nil {
+		return &userdata, err
+	}
+	err = json.Unmarshal(userdataEntry, userdataptr)
+	if err != nil {
+		return &userdata, err
+	}
+
+	usageKey, err := userlib.HashKDF(rootKey, []byte("usage-key"))
+	if err != nil {
+		return &userdata, err
+	}
+	dedupKey, err := userlib.HashKDF(rootKey, []byte("dedup-key"))
+	if err != nil {
+		return &userdata, err
+	}
+
+	// Add derived keys to user struct
+	userdata.encKey = encKey
+	userdata.macKey = macKey
+	userdata.usageKey = usageKey
+	userdata.dedupKey = dedupKey[:16]
+
+	return userdataptr, nil
+}
+
+func (userdata *User) StoreFile(filename string, content []byte) (err error) {
+	err = checkSettings()
+	if err != nil {
+		return err
+	}
+
+	// Get file node from datastore
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+
+	// If filenode exists, overwrite. o.w make new file
+	if err != nil && err != errNotFound {
+		return err
+	}
+	if err == errNotFound {
+		// Generate File Key and File Mac Key
+		fileKey := userlib.RandomBytes(16)
+		fileMacKey, err := userlib.HashKDF(fileKey, []byte("mac-key"))
+		if err != nil {
+			return err
+		}
+		fileHead, err := newFileHead(userdata, filename)
+		if err != nil {
+			return err
+		}
+		err = checkQuota(userdata, fileHead, len(content))
+		if err != nil {
+			return err
+		}
+
+		// Encrypt contents in chunks and store in datastore
+		fileHead.FirstNode, fileHead.LastNode, err = writeChunks(fileKey, fileMacKey, writeKey, chunkKey(userdata, fileHead), &fileHead, content)
+		if err != nil {
+			return err
+		}
+		fileHeadId := uuid.New()
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+		if err != nil {
+			return err
+		}
+		err = chargeUsage(userdata, FileHead{}, fileHead)
+		if err != nil {
+			return err
+		}
+		return createFile(userdata, filename, fileKey, fileMacKey, fileHeadId)
+	} else {
+		err = checkWritable(fileKey, writeKey)
+		if err != nil {
+			return err
+		}
+
+		// Get fileHead struct
+		fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+		if err != nil {
+			return err
+		}
+		before := fileHead
+		err = checkQuota(userdata, fileHead, len(content))
+		if err != nil {
+			return err
+		}
+
+		// Keep old content as a version, and delete anything left from compaction
+		err = saveVersion(fileKey, fileMacKey, writeKey, &fileHead)
+		if err != nil {
+			return err
+		}
+		err = deleteRetired(fileKey, fileMacKey, &fileHead)
+		if err != nil {
+			return err
+		}
+
+		// Encrypt new contents in chunks and store in datastore
+		fileHead.Modified = time.Now()
+		fileHead.LastWriter = userdata.Username
+		fileHead.FirstNode, fileHead.LastNode, err = writeChunks(fileKey, fileMacKey, writeKey, chunkKey(userdata, fileHead), &fileHead, content)
+		if err != nil {
+			return err
+		}
+
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+		if err != nil {
+			return err
+		}
+		err = chargeUsage(userdata, before, fileHead)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (userdata *User) AppendToFile(filename string, content []byte) error {
+	err := checkSettings()
+	if err != nil {
+		return err
+	}
+
+	// Get the file keys, append-only recipients have none and write to their drop box
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err == ErrAppendOnly {
+		return appendToDrop(userdata, filename, content)
+	}
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+
+	// Get fileHead struct and its UUID
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	before := fileHead
+	err = checkQuota(userdata, fileHead, len(content))
+	if err != nil {
+		return err
+	}
+
+	// Encrypt contents in chunks and add them to the list
+	err = appendChunks(fileKey, fileMacKey, writeKey, chunkKey(userdata, fileHead), &fileHead, content)
+	if err != nil {
+		return err
+	}
+	fileHead.Modified = time.Now()
+	fileHead.LastWriter = userdata.Username
+
+	// Encrypt and store fileHead, charging the owner for the new nodes
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+	if err != nil {
+		return err
+	}
+	err = chargeUsage(userdata, before, fileHead)
+	if err != nil {
+		return err
+	}
+
+	// Compact long chains automatically if enabled, but only once the chain is at least twice
+	// as long as compacting leaves it, so a threshold below that doesn't rewrite every append.
+	// Deduplicated chunks are about half of ChunkSize
+	compacted := (fileHead.Size + ChunkSize - 1) / ChunkSize
+	if fileHead.Dedup {
+		compacted *= 2
+	}
+	if CompactThreshold > 0 && fileHead.NumNodes > CompactThreshold && fileHead.NumNodes >= 2*compacted {
+		return compactFile(userdata, fileKey, fileMacKey, writeKey, fileHeadId)
+	}
+
+	return nil
+}
+
+func (userdata *User) CompactFile(filename string) error {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+
+	// Get fileHead UUID, which stays the same so recipients keep access
+	_, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+
+	return compactFile(userdata, fileKey, fileMacKey, writeKey, fileHeadId)
+}
+
+func (userdata *User) CopyFile(src string, dst string) error {
+	// Get the source file keys and fileHead
+	srcNodeId, srcKey, srcMacKey, srcWriteKey, err := lookupFile(userdata, src)
+	if err != nil {
+		return err
+	}
+	srcHead, _, err := getFileHead(srcKey, srcMacKey, srcWriteKey, srcNodeId)
+	if err != nil {
+		return err
+	}
+
+	// Create the copy empty so it gets its own file key and records
+	_, _, _, _, err = lookupFile(userdata, dst)
+	if err == nil || err == ErrAppendOnly {
+		return errors.New("destination file already exists")
+	}
+	if err != errNotFound {
+		return err
+	}
+	err = userdata.StoreFile(dst, []byte{})
+	if err != nil {
+		return err
+	}
+	dstNodeId, dstKey, dstMacKey, dstWriteKey, err := lookupFile(userdata, dst)
+	if err != nil {
+		return err
+	}
+	dstHead, dstHeadId, err := getFileHead(dstKey, dstMacKey, dstWriteKey, dstNodeId)
+	if err != nil {
+		return err
+	}
+	before := dstHead
+	err = checkQuota(userdata, dstHead, srcHead.Size)
+	if err != nil {
+		return err
+	}
+	err = deleteChain(dstKey, dstMacKey, dstHead.FirstNode)
+	if err != nil {
+		return err
+	}
+	deleteIndex(&dstHead)
+	dstHead.Size = 0
+	dstHead.NumNodes = 0
+
+	// Give the copy its own nodes sharing the source's contents, and the same attributes
+	err = copyChain(srcKey, srcMacKey, dstKey, dstMacKey, dstWriteKey, &dstHead, srcHead.FirstNode)
+	if err != nil {
+		return err
+	}
+	dstHead.Attrs = srcHead.Attrs
+
+	// Encrypt and store the copy's fileHead
+	err = fileEncThenTag(dstKey, dstMacKey, dstWriteKey, dstHead, dstHeadId)
+	if err != nil {
+		return err
+	}
+	err = chargeUsage(userdata, before, dstHead)
+	if err != nil {
+		return err
+	}
+	return indexFile(userdata, dst, splitLabels(dstHead.Attrs[AttrLabels]))
+}
+
+func (userdata *User) ListVersions(filename string) (versions []VersionInfo, err error) {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return versions, err
+	}
+
+	// Get fileHead struct, then each version's head
+	fileHead, _, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return versions, err
+	}
+	versions = []VersionInfo{}
+	for _, versionId := range fileHead.Versions {
+		snapshot, err := getVersion(fileKey, fileMacKey, versionId)
+		if err != nil {
+			return versions, err
+		}
+		versions = append(versions, VersionInfo{
+			Version:    snapshot.Version,
+			Size:       snapshot.Size,
+			Modified:   snapshot.Modified,
+			LastWriter: snapshot.LastWriter,
+		})
+	}
+	return versions, nil
+}
+
+func (userdata *User) LoadVersion(filename string, version int) (content []byte, err error) {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return content, err
+	}
+
+	// Get fileHead struct then the version's head
+	fileHead, _, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return content, err
+	}
+	snapshot, err := findVersion(fileKey, fileMacKey, fileHead, version)
+	if err != nil {
+		return content, err
+	}
+
+	// Read the version's chain the same way a reader does
+	reader := &fileReader{fileKey: fileKey, fileMacKey: fileMacKey, nextNode: snapshot.FirstNode}
+	return io.ReadAll(reader)
+}
+
+func (userdata *User) RestoreVersion(filename string, version int) error {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+
+	// Get fileHead struct then the version's head
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	snapshot, err := findVersion(fileKey, fileMacKey, fileHead, version)
+	if err != nil {
+		return err
+	}
+	before := fileHead
+	err = checkQuota(userdata, fileHead, snapshot.Size)
+	if err != nil {
+		return err
+	}
+
+	// Share the version's contents before keeping the current content as a version,
+	// which may prune the one being restored
+	var restored FileHead
+	err = copyChain(fileKey, fileMacKey, fileKey, fileMacKey, writeKey, &restored, snapshot.FirstNode)
+	if err != nil {
+		return err
+	}
+	err = saveVersion(fileKey, fileMacKey, writeKey, &fileHead)
+	if err != nil {
+		return err
+	}
+
+	fileHead.FirstNode = restored.FirstNode
+	fileHead.LastNode = restored.LastNode
+	fileHead.Size = restored.Size
+	fileHead.NumNodes = restored.NumNodes
+	fileHead.IndexPages = restored.IndexPages
+	fileHead.PageOffsets = restored.PageOffsets
+	fileHead.Modified = time.Now()
+	fileHead.LastWriter = userdata.Username
+
+	// Encrypt and store fileHead, charging the owner for the change
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+	if err != nil {
+		return err
+	}
+	return chargeUsage(userdata, before, fileHead)
+}
+
+func (userdata *User) SetVersionLimit(filename string, limit int) error {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+	if limit < 0 {
+		return errors.New("version limit must not be negative")
+	}
+
+	// Get fileHead struct, then drop versions past the new limit
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	before := fileHead
+	fileHead.MaxVersions = limit
+	err = pruneVersions(fileKey, fileMacKey, &fileHead)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt and store fileHead, charging the owner for the change
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+	if err != nil {
+		return err
+	}
+	return chargeUsage(userdata, before, fileHead)
+}
+
+func (userdata *User) SetCompression(filename string, compression string, pad bool) error {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+	if compression != CompressNone && compression != CompressDeflate {
+		return errors.New("unknown compression")
+	}
+
+	// Only chunks written from now on are compressed, CompactFile rewrites existing ones
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	fileHead.Compression = compression
+	fileHead.PadCompressed = pad
+
+	// Encrypt and store fileHead
+	return fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+}
+
+func (userdata *User) SetDedup(filename string, dedup bool) error {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+
+	// Only chunks written from now on are deduplicated
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	fileHead.Dedup = dedup
+
+	// Encrypt and store fileHead
+	return fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+}
+
+func (userdata *User) SetAttr(filename string, name string, value string) error {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("attribute name must not be empty")
+	}
+
+	// Get fileHead struct, an empty value removes the attribute
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	if value == "" {
+		delete(fileHead.Attrs, name)
+	} else {
+		if fileHead.Attrs == nil {
+			fileHead.Attrs = make(map[string]string)
+		}
+		fileHead.Attrs[name] = value
+	}
+
+	// Encrypt and store fileHead, keeping the search index's copy of labels up to date
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+	if err != nil {
+		return err
+	}
+	if name == AttrLabels {
+		return indexFile(userdata, filename, splitLabels(value))
+	}
+	return nil
+}
+
+func (userdata *User) GetAttr(filename string, name string) (value string, err error) {
+	attrs, err := userdata.ListAttrs(filename)
+	if err != nil {
+		return "", err
+	}
+	value, ok := attrs[name]
+	if !ok {
+		return "", errors.New("attribute does not exist")
+	}
+	return value, nil
+}
+
+func (userdata *User) ListAttrs(filename string) (attrs map[string]string, err error) {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get fileHead struct, which holds the attributes
+	fileHead, _, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return nil, err
+	}
+	attrs = fileHead.Attrs
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	return attrs, nil
+}
+
+func (userdata *User) LoadFile(filename string) (content []byte, err error) {
+	// Add anything append-only recipients have contributed first
+	err = collectContributions(userdata, filename)
+	if err != nil {
+		return content, err
+	}
+
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return content, err
+	}
+
+	// Get fileHead struct and its UUID
+	fileHead, _, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return content, err
+	}
+
+	// Verify then decrypt first content node
+	contentNodeId := fileHead.FirstNode
+	contentNodeEntry, err := fileVerifyThenDec(fileKey, fileMacKey, contentNodeId)
+	if err != nil {
+		return content, err
+	}
+	var contentNode ContentNode
+	err = json.Unmarshal(contentNodeEntry, &contentNode)
+	if err != nil {
+		return content, err
+	}
+
+	// Get contents of first node and add to content
+	content, err = getContents(contentNode)
+	if err != nil {
+		return content, err
+	}
+
+	// Recursively add content from nodes in linked list
+	for contentNode.NextNode != uuid.Nil {
+		// Verify then decrypt next node
+		contentNodeEntry, err := fileVerifyThenDec(fileKey, fileMacKey, contentNode.NextNode)
+		if err != nil {
+			return content, err
+		}
+		err = json.Unmarshal(contentNodeEntry, &contentNode)
+		if err != nil {
+			return content, err
+		}
+
+		// Verify then decrypt content
+		contentBytes, err := getContents(contentNode)
+		if err != nil {
+			return content, err
+		}
+
+		// Append to content and iterate down list
+		content = append(content, contentBytes...)
+	}
+
+	return content, nil
+}
+
+func (userdata *User) ReadAt(filename string, offset int, length int) (content []byte, err error) {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return content, err
+	}
+
+	// Get fileHead struct and check bounds, reads past the end come back short
+	fileHead, _, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return content, err
+	}
+	if offset < 0 || length < 0 {
+		return content, errors.New("offset and length must not be negative")
+	}
+	if offset > fileHead.Size {
+		return content, errors.New("offset is past end of file")
+	}
+	end := offset + length
+	if end > fileHead.Size {
+		end = fileHead.Size
+	}
+	content = []byte{}
+	if offset == end {
+		return content, nil
+	}
+
+	// Find the first node overlapping offset
+	page, _, n, err := findContentNode(fileKey, fileMacKey, fileHead, offset)
+	if err != nil {
+		return content, err
+	}
+
+	// Only download contents of nodes overlapping [offset, end)
+	contentNodeId := page.Nodes[n]
+	nodeOffset := page.Offsets[n]
+	for nodeOffset < end && contentNodeId != uuid.Nil {
+		contentNode, err := getContentNode(fileKey, fileMacKey, contentNodeId)
+		if err != nil {
+			return content, err
+		}
+		if nodeOffset+contentNode.Size > offset {
+			contents, err := getContents(contentNode)
+			if err != nil {
+				return content, err
+			}
+			lo := 0
+			if offset > nodeOffset {
+				lo = offset - nodeOffset
+			}
+			hi := len(contents)
+			if end-nodeOffset < hi {
+				hi = end - nodeOffset
+			}
+			if lo > hi {
+				return content, errors.New("content node sizes do not match index")
+			}
+			content = append(content, contents[lo:hi]...)
+		}
+		nodeOffset += contentNode.Size
+		contentNodeId = contentNode.NextNode
+	}
+
+	return content, nil
+}
+
+func (userdata *User) WriteAt(filename string, offset int, data []byte) error {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+
+	// Get fileHead struct and check bounds, writes may run past the end but not start after it
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	if offset < 0 {
+		return errors.New("offset must not be negative")
+	}
+	if offset > fileHead.Size {
+		return errors.New("offset is past end of file")
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	end := offset + len(data)
+	before := fileHead
+	if end > fileHead.Size {
+		err = checkQuota(userdata, fileHead, end-fileHead.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Rewrite contents of nodes overlapping [offset, end), their sizes don't change
+	if offset < fileHead.Size {
+		page, _, n, err := findContentNode(fileKey, fileMacKey, fileHead, offset)
+		if err != nil {
+			return err
+		}
+		contentNodeId := page.Nodes[n]
+		nodeOffset := page.Offsets[n]
+		for nodeOffset < end && contentNodeId != uuid.Nil {
+			contentNode, err := getContentNode(fileKey, fileMacKey, contentNodeId)
+			if err != nil {
+				return err
+			}
+			if nodeOffset+contentNode.Size > offset {
+				contents, err := getContents(contentNode)
+				if err != nil {
+					return err
+				}
+				if len(contents) != contentNode.Size {
+					return errors.New("content node sizes do not match index")
+				}
+				lo := 0
+				if offset > nodeOffset {
+					lo = offset - nodeOffset
+				}
+				copy(contents[lo:], data[nodeOffset+lo-offset:])
+
+				// Contents may be shared with a copy, so write them anew before releasing
+				oldNode := contentNode
+				err = putContents(&contentNode, contents, &fileHead, chunkKey(userdata, fileHead))
+				if err != nil {
+					return err
+				}
+				err = fileEncThenTag(fileKey, fileMacKey, writeKey, contentNode, contentNodeId)
+				if err != nil {
+					return err
+				}
+				err = releaseContents(oldNode)
+				if err != nil {
+					return err
+				}
+			}
+			nodeOffset += contentNode.Size
+			contentNodeId = contentNode.NextNode
+		}
+	}
+
+	// Anything past the old end is appended as new nodes
+	if end > fileHead.Size {
+		err = appendChunks(fileKey, fileMacKey, writeKey, chunkKey(userdata, fileHead), &fileHead, data[fileHead.Size-offset:])
+		if err != nil {
+			return err
+		}
+	}
+	fileHead.Modified = time.Now()
+	fileHead.LastWriter = userdata.Username
+
+	// Encrypt and store fileHead, charging the owner for the change
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+	if err != nil {
+		return err
+	}
+	return chargeUsage(userdata, before, fileHead)
+}
+
+func (userdata *User) Truncate(filename string, size int) error {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
+
+	// Get fileHead struct and its UUID
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		return errors.New("size must not be negative")
+	}
+	if size == fileHead.Size {
+		return nil
+	}
+	before := fileHead
+	if size > fileHead.Size {
+		err = checkQuota(userdata, fileHead, size-fileHead.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	if size > fileHead.Size {
+		// Growing a file pads it with zero bytes
+		err = appendChunks(fileKey, fileMacKey, writeKey, chunkKey(userdata, fileHead), &fileHead, make([]byte, size-fileHead.Size))
+		if err != nil {
+			return err
+		}
+	} else if size == 0 {
+		// Emptying a file leaves it with a single empty node
+		err = deleteChain(fileKey, fileMacKey, fileHead.FirstNode)
+		if err != nil {
+			return err
+		}
+		deleteIndex(&fileHead)
+		fileHead.Size = 0
+		fileHead.NumNodes = 0
+		fileHead.FirstNode, fileHead.LastNode, err = writeChunks(fileKey, fileMacKey, writeKey, chunkKey(userdata, fileHead), &fileHead, []byte{})
+		if err != nil {
+			return err
+		}
+	} else {
+		// Find the node the new end falls in
+		page, p, n, err := findContentNode(fileKey, fileMacKey, fileHead, size-1)
+		if err != nil {
+			return err
+		}
+		contentNodeId := page.Nodes[n]
+		nodeOffset := page.Offsets[n]
+		contentNode, err := getContentNode(fileKey, fileMacKey, contentNodeId)
+		if err != nil {
+			return err
+		}
+		contents, err := getContents(contentNode)
+		if err != nil {
+			return err
+		}
+		if size-nodeOffset > len(contents) {
+			return errors.New("content node sizes do not match index")
+		}
+
+		// Cut that node down, then delete every node after it
+		oldNode := contentNode
+		tail := contentNode.NextNode
+		err = putContents(&contentNode, contents[:size-nodeOffset], &fileHead, chunkKey(userdata, fileHead))
+		if err != nil {
+			return err
+		}
+		contentNode.NextNode = uuid.Nil
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, contentNode, contentNodeId)
+		if err != nil {
+			return err
+		}
+		err = releaseContents(oldNode)
+		if err != nil {
+			return err
+		}
+		err = deleteChain(fileKey, fileMacKey, tail)
+		if err != nil {
+			return err
+		}
+
+		// Trim the index to end at that node, every page before it is full
+		page.Nodes = page.Nodes[:n+1]
+		page.Offsets = page.Offsets[:n+1]
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, page, fileHead.IndexPages[p])
+		if err != nil {
+			return err
+		}
+		for _, pageId := range fileHead.IndexPages[p+1:] {
+			userlib.DatastoreDelete(pageId)
+		}
+		fileHead.IndexPages = fileHead.IndexPages[:p+1]
+		fileHead.PageOffsets = fileHead.PageOffsets[:p+1]
+		fileHead.LastNode = contentNodeId
+		fileHead.Size = size
+		fileHead.NumNodes = p*indexPageSize + n + 1
+	}
+	fileHead.Modified = time.Now()
+	fileHead.LastWriter = userdata.Username
+
+	// Encrypt and store fileHead, charging the owner for the change
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+	if err != nil {
+		return err
+	}
+	return chargeUsage(userdata, before, fileHead)
+}
+
+func (reader *fileReader) Read(p []byte) (n int, err error) {
+	if reader.closed {
+		return 0, errors.New("reader is closed")
+	}
+
+	// Fetch the next node once everything buffered has been read, skipping empty ones
+	for len(reader.buffer) == 0 {
+		if reader.nextNode == uuid.Nil {
+			return 0, io.EOF
+		}
+		contentNode, err := getContentNode(reader.fileKey, reader.fileMacKey, reader.nextNode)
+		if err != nil {
+			return 0, err
+		}
+		reader.buffer, err = getContents(contentNode)
+		if err != nil {
+			return 0, err
+		}
+		reader.nextNode = contentNode.NextNode
+	}
+
+	n = copy(p, reader.buffer)
+	reader.buffer = reader.buffer[n:]
+	return n, nil
+}
+
+func (reader *fileReader) Close() error {
+	reader.closed = true
+	reader.buffer = nil
+	return nil
+}
+
+func (writer *fileWriter) Write(p []byte) (n int, err error) {
+	if writer.closed {
+		return 0, errors.New("writer is closed")
+	}
+	err = checkSettings()
+	if err != nil {
+		return 0, err
+	}
+
+	buffered := len(writer.buffer)
+	writer.buffer = append(writer.buffer, p...)
+	flushed := 0
+	for len(writer.buffer)-flushed >= ChunkSize {
+		err = writer.flush(writer.buffer[flushed : flushed+ChunkSize])
+		if err != nil {
+			// Only the part of p that reached the file counts as written, and the rest is
+			// dropped so the caller can write it again
+			if flushed > buffered {
+				n = flushed - buffered
+			}
+			writer.buffer = writer.buffer[flushed : buffered+n]
+			return n, err
+		}
+		flushed += ChunkSize
+	}
+	writer.buffer = writer.buffer[flushed:]
+	return len(p), nil
+}
+
+// Store a chunk as the file's next content node
+func (writer *fileWriter) flush(chunk []byte) (err error) {
+	if writer.truncate {
+		writer.truncate = false
+		return writer.user.StoreFile(writer.filename, chunk)
+	}
+	return writer.user.AppendToFile(writer.filename, chunk)
+}
+
+func (writer *fileWriter) Close() error {
+	if writer.closed {
+		return errors.New("writer is closed")
+	}
+	writer.closed = true
+	if len(writer.buffer) == 0 {
+		return nil
+	}
+	err := writer.flush(writer.buffer)
+	writer.buffer = nil
+	return err
+}
+
+func (userdata *User) OpenReader(filename string) (reader io.ReadCloser, err error) {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return reader, err
+	}
+
+	// Content nodes are only fetched as they're read
+	fileHead, _, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return reader, err
+	}
+	return &fileReader{fileKey: fileKey, fileMacKey: fileMacKey, nextNode: fileHead.FirstNode}, nil
+}
+
+func (userdata *User) CreateWriter(filename string) (writer io.WriteCloser, err error) {
+	// Create or empty the file now, the first chunk then replaces the empty content
+	err = userdata.StoreFile(filename, []byte{})
+	if err != nil {
+		return writer, err
+	}
+	return &fileWriter{user: userdata, filename: filename, truncate: true}, nil
 }
 
-func InitUser(username string, password string) (userdataptr *User, err error) {
-	if username == "" {
-		return userdataptr, errors.New("invalid username")
+func (userdata *User) AppendWriter(filename string) (writer io.WriteCloser, err error) {
+	// Make sure the file exists before accepting any data
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return writer, err
+	}
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return writer, err
+	}
+	_, _, err = getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return writer, err
 	}
+	return &fileWriter{user: userdata, filename: filename}, nil
+}
 
-	var userdata User
-	userdata.Username = username
+func (userdata *User) Begin() (batch *Batch) {
+	return &Batch{user: userdata}
+}
 
-	// Get sign and verify keys for digital signatures
-	DSSignKey, DSVerifyKey, err := userlib.DSKeyGen()
+// Find a file already staged in the batch, or start staging it from its current head.
+// Missing files are staged with a new head and only created when the batch commits
+func (batch *Batch) stage(filename string) (file *stagedFile, err error) {
+	if batch.committed {
+		return nil, errors.New("batch is already committed")
+	}
+	for _, file = range batch.files {
+		if file.created && file.filename == filename {
+			return file, nil
+		}
+	}
+
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(batch.user, filename)
+	if err != nil && err != errNotFound {
+		return nil, err
+	}
+	if err == errNotFound {
+		fileKey = userlib.RandomBytes(16)
+		fileMacKey, err = userlib.HashKDF(fileKey, []byte("mac-key"))
+		if err != nil {
+			return nil, err
+		}
+		fileHead, err := newFileHead(batch.user, filename)
+		if err != nil {
+			return nil, err
+		}
+		file = &stagedFile{
+			filename:   filename,
+			fileKey:    fileKey,
+			fileMacKey: fileMacKey,
+			fileHeadId: uuid.New(),
+			before:     fileHead,
+			head:       fileHead,
+			created:    true,
+			fresh:      true,
+		}
+		batch.files = append(batch.files, file)
+		return file, nil
+	}
+
+	// Every name linked to a file shares its staged head
+	for _, file = range batch.files {
+		if !file.created && file.fileNodeId == fileNodeId {
+			return file, nil
+		}
+	}
+	err = checkWritable(fileKey, writeKey)
 	if err != nil {
-		return &userdata, err
+		return nil, err
+	}
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return nil, err
 	}
 
-	// Add sign key to struct, verify key to Keystore
-	userdata.DSSignKey = DSSignKey
-	id := getUUID("ds", username)
-	err = userlib.KeystoreSet(id.String(), DSVerifyKey)
+	file = &stagedFile{
+		filename:   filename,
+		fileNodeId: fileNodeId,
+		fileKey:    fileKey,
+		fileMacKey: fileMacKey,
+		writeKey:   writeKey,
+		fileHeadId: fileHeadId,
+		before:     fileHead,
+		head:       fileHead,
+	}
+	batch.files = append(batch.files, file)
+	return file, nil
+}
+
+func (batch *Batch) Store(filename string, content []byte) error {
+	file, err := batch.stage(filename)
 	if err != nil {
-		return &userdata, err
+		return err
+	}
+	err = checkQuota(batch.user, file.head, len(content))
+	if err != nil {
+		return err
 	}
 
-	// Get public and private keys for enc/dec
-	PKEEncKey, PKEDecKey, err := userlib.PKEKeyGen()
+	// Keep old content as a version, deleting nothing until the batch commits. New files
+	// have none until something is written to them
+	if !file.created || file.head.FirstNode != uuid.Nil {
+		err = stageVersion(file.fileKey, file.fileMacKey, file.writeKey, &file.head)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Encrypt new contents in chunks, unreachable until the head is published
+	file.head.Modified = time.Now()
+	file.head.LastWriter = batch.user.Username
+	file.head.FirstNode, file.head.LastNode, err = writeChunks(file.fileKey, file.fileMacKey, file.writeKey, chunkKey(batch.user, file.head), &file.head, content)
 	if err != nil {
-		return &userdata, err
+		return err
 	}
+	file.chains = append(file.chains, file.head.FirstNode)
+	file.fresh = true
+	return nil
+}
 
-	// Add public key to keystore, private key to struct
-	userdata.PKEDecKey = PKEDecKey
-	id = getUUID("pke", username)
-	err = userlib.KeystoreSet(id.String(), PKEEncKey)
+func (batch *Batch) Append(filename string, content []byte) error {
+	file, err := batch.stage(filename)
 	if err != nil {
-		return &userdata, err
+		return err
 	}
+	err = checkQuota(batch.user, file.head, len(content))
+	if err != nil {
+		return err
+	}
+	file.head.Modified = time.Now()
+	file.head.LastWriter = batch.user.Username
 
-	// Generate root key using salt and password
-	salt := userlib.RandomBytes(32)
-	rootKey := userlib.Argon2Key([]byte(password), salt, 16)
+	// Chains written by this batch aren't published yet, so can be appended to as usual
+	if file.fresh {
+		started := file.head.FirstNode == uuid.Nil
+		err = appendChunks(file.fileKey, file.fileMacKey, file.writeKey, chunkKey(batch.user, file.head), &file.head, content)
+		if err != nil {
+			return err
+		}
+		if started {
+			file.chains = append(file.chains, file.head.FirstNode)
+		}
+		return nil
+	}
 
-	// Derive encryption/authentication keys
-	encKey, err := userlib.HashKDF(rootKey, []byte("enc-key"))
+	// Otherwise index into a copy of the last page and leave the new chain unlinked
+	if last := len(file.head.IndexPages) - 1; last >= 0 {
+		pageEntry, err := fileVerifyThenDec(file.fileKey, file.fileMacKey, file.head.IndexPages[last])
+		if err != nil {
+			return err
+		}
+		var page IndexPage
+		err = json.Unmarshal(pageEntry, &page)
+		if err != nil {
+			return err
+		}
+		pageId := uuid.New()
+		err = fileEncThenTag(file.fileKey, file.fileMacKey, file.writeKey, page, pageId)
+		if err != nil {
+			return err
+		}
+		file.oldPages = append(file.oldPages, file.head.IndexPages[last])
+		file.head.IndexPages = append(append([]uuid.UUID{}, file.head.IndexPages[:last]...), pageId)
+	}
+	firstNodeId, lastNodeId, err := writeChunks(file.fileKey, file.fileMacKey, file.writeKey, chunkKey(batch.user, file.head), &file.head, content)
 	if err != nil {
-		return &userdata, err
+		return err
 	}
-	macKey, err := userlib.HashKDF(rootKey, []byte("mac-key"))
+	file.linkNode = file.head.LastNode
+	file.linkTo = firstNodeId
+	file.head.LastNode = lastNodeId
+	file.chains = append(file.chains, firstNodeId)
+	file.fresh = true
+	return nil
+}
+
+// Publish every staged head at once. Each published head is first marked with the batch and
+// its staged head, and new files get their head and a pending record, then the batch commits
+// with a single write of its record. After that any reader of a marked head publishes the
+// staged one, and the user's next lookup lists any new file the batch didn't. A batch that
+// stops before then leaves every file as it was. If any file changed since it was staged, or
+// a new one was created by someone else, nothing is published and the batch is aborted
+func (batch *Batch) Commit() error {
+	if batch.committed {
+		return errors.New("batch is already committed")
+	}
+	batch.committed = true
+
+	for _, file := range batch.files {
+		if file.created {
+			_, _, _, _, err := lookupFile(batch.user, file.filename)
+			if err != errNotFound {
+				batch.discard()
+				return errors.New(file.filename + " was created since the batch staged it")
+			}
+			continue
+		}
+		fileHead, err := loadFileHead(file.fileKey, file.fileMacKey, file.writeKey, file.fileHeadId)
+		if err != nil {
+			batch.discard()
+			return err
+		}
+		current, err := json.Marshal(fileHead)
+		if err != nil {
+			return err
+		}
+		staged, err := json.Marshal(file.before)
+		if err != nil {
+			return err
+		}
+		if string(current) != string(staged) {
+			batch.discard()
+			return errors.New(file.filename + " changed since the batch staged it")
+		}
+	}
+
+	err := batch.prepare()
 	if err != nil {
-		return &userdata, err
+		return err
 	}
 
-	// Store salt in datastore
-	id = getUUID("salt", username)
-	userlib.DatastoreSet(id, salt)
+	// Commit point
+	userlib.DatastoreSet(batch.id, batch.token)
+	return batch.publish()
+}
 
-	// Tag user struct and store in datastore
-	id = getUUID("struct", username)
-	err = symEncThenTag(encKey, macKey, userdata, id)
+// Store every staged head and mark the published ones with the batch, and give new files
+// their heads and a pending record. Nothing here is visible until the batch commits
+func (batch *Batch) prepare() (err error) {
+	batch.token = userlib.RandomBytes(16)
+	batch.id = uuid.New()
+	batch.pending = PendingBatch{Batch: batch.id, BatchHash: userlib.Hash(batch.token)}
+	for _, file := range batch.files {
+		staged := file.head
+		staged.LinkNode = file.linkNode
+		staged.LinkTo = file.linkTo
+
+		// Nothing leads to a new file's head until it's listed, so it's stored as published
+		if file.created {
+			_, err = publishFileHead(file.fileKey, file.fileMacKey, file.writeKey, file.fileHeadId, staged)
+			if err != nil {
+				return err
+			}
+			batch.pending.Files = append(batch.pending.Files, PendingFile{Filename: file.filename, Key: file.fileKey, Head: file.fileHeadId})
+			continue
+		}
+		file.stagedId = uuid.New()
+		err = fileEncThenTag(file.fileKey, file.fileMacKey, file.writeKey, staged, file.stagedId)
+		if err != nil {
+			return err
+		}
+
+		marked := file.before
+		marked.Batch = batch.id
+		marked.BatchHash = userlib.Hash(batch.token)
+		marked.Staged = file.stagedId
+		err = fileEncThenTag(file.fileKey, file.fileMacKey, file.writeKey, marked, file.fileHeadId)
+		if err != nil {
+			return err
+		}
+	}
+	if batch.pending.Files != nil {
+		return addPendingBatch(batch.user, batch.pending)
+	}
+	return nil
+}
+
+// Publish every staged head and list every new file of a committed batch, then delete what
+// it replaced
+func (batch *Batch) publish() (err error) {
+	for _, file := range batch.files {
+		fileHead := file.head
+		if file.created {
+			err = createFile(batch.user, file.filename, file.fileKey, file.fileMacKey, file.fileHeadId)
+			if err != nil {
+				return err
+			}
+		} else {
+			staged := file.head
+			staged.LinkNode = file.linkNode
+			staged.LinkTo = file.linkTo
+			fileHead, err = publishFileHead(file.fileKey, file.fileMacKey, file.writeKey, file.fileHeadId, staged)
+			if err != nil {
+				return err
+			}
+			userlib.DatastoreDelete(file.stagedId)
+		}
+
+		// Delete what the batch replaced, then drop versions past the file's limit
+		for _, pageId := range file.oldPages {
+			userlib.DatastoreDelete(pageId)
+		}
+		if len(fileHead.Versions) > fileHead.MaxVersions {
+			err = pruneVersions(file.fileKey, file.fileMacKey, &fileHead)
+			if err != nil {
+				return err
+			}
+			err = fileEncThenTag(file.fileKey, file.fileMacKey, file.writeKey, fileHead, file.fileHeadId)
+			if err != nil {
+				return err
+			}
+		}
+		err = chargeUsage(batch.user, file.before, fileHead)
+		if err != nil {
+			return err
+		}
+	}
+	if batch.pending.Files != nil {
+		err = removePendingBatch(batch.user, batch.id)
+		if err != nil {
+			return err
+		}
+	}
+	userlib.DatastoreDelete(batch.id)
+	return nil
+}
+
+func getPendingBatches(user *User) (pending []PendingBatch, err error) {
+	pendingId := getUUID("batches", user.Username)
+	if _, ok := userlib.DatastoreGet(pendingId); !ok {
+		return pending, nil
+	}
+
+	// Verify then decrypt pending batches
+	pendingEntry, err := symVerifyThenDec(user.encKey, user.macKey, pendingId)
 	if err != nil {
-		return &userdata, err
+		return pending, err
+	}
+	err = json.Unmarshal(pendingEntry, &pending)
+	if err != nil {
+		return pending, err
 	}
+	return pending, nil
+}
 
-	// Add derived keys to user struct
-	userdata.encKey = encKey
-	userdata.macKey = macKey
+func putPendingBatches(user *User, pending []PendingBatch) (err error) {
+	pendingId := getUUID("batches", user.Username)
+	if len(pending) == 0 {
+		userlib.DatastoreDelete(pendingId)
+		return nil
+	}
+	return symEncThenTag(user.encKey, user.macKey, pending, pendingId)
+}
 
-	return &userdata, nil
+func addPendingBatch(user *User, batch PendingBatch) (err error) {
+	pending, err := getPendingBatches(user)
+	if err != nil {
+		return err
+	}
+	return putPendingBatches(user, append(pending, batch))
+}
+
+func removePendingBatch(user *User, batchId uuid.UUID) (err error) {
+	pending, err := getPendingBatches(user)
+	if err != nil {
+		return err
+	}
+	for i, batch := range pending {
+		if batch.Batch == batchId {
+			return putPendingBatches(user, append(pending[:i], pending[i+1:]...))
+		}
+	}
+	return nil
+}
+
+// List the new files of batches that committed but stopped before listing them all, skipping
+// names taken since. The record is cleared first, so the lookups here don't come back to it.
+// Batches that haven't committed are dropped, which only gives up on listing their files if
+// they do commit and then stop
+func finishBatches(user *User) (err error) {
+	pending, err := getPendingBatches(user)
+	if err != nil || len(pending) == 0 {
+		return err
+	}
+	err = putPendingBatches(user, nil)
+	if err != nil {
+		return err
+	}
+	for _, batch := range pending {
+		token, ok := userlib.DatastoreGet(batch.Batch)
+		if !ok || !userlib.HMACEqual(userlib.Hash(token), batch.BatchHash) {
+			continue
+		}
+		for _, file := range batch.Files {
+			_, _, _, _, err := lookupFile(user, file.Filename)
+			if err != errNotFound {
+				continue
+			}
+			fileMacKey, err := userlib.HashKDF(file.Key, []byte("mac-key"))
+			if err != nil {
+				return err
+			}
+			createFile(user, file.Filename, file.Key, fileMacKey, file.Head)
+		}
+	}
+	return nil
+}
+
+// Give up on a batch, deleting everything it wrote. None of it was ever published
+func (batch *Batch) Abort() error {
+	if batch.committed {
+		return errors.New("batch is already committed")
+	}
+	batch.committed = true
+	return batch.discard()
+}
+
+// Delete the chains, index pages and versions a batch wrote, leaving what it staged from
+func (batch *Batch) discard() (err error) {
+	for _, file := range batch.files {
+		kept := make(map[uuid.UUID]bool)
+		for _, pageId := range file.before.IndexPages {
+			kept[pageId] = true
+		}
+		for _, versionId := range file.before.Versions {
+			kept[versionId] = true
+		}
+		pages := file.head.IndexPages
+		for _, versionId := range file.head.Versions {
+			if kept[versionId] {
+				continue
+			}
+			snapshot, err := getVersion(file.fileKey, file.fileMacKey, versionId)
+			if err != nil {
+				return err
+			}
+			pages = append(pages, snapshot.IndexPages...)
+			userlib.DatastoreDelete(versionId)
+		}
+		for _, pageId := range pages {
+			if !kept[pageId] {
+				userlib.DatastoreDelete(pageId)
+			}
+		}
+		for _, firstNodeId := range file.chains {
+			err = deleteChain(file.fileKey, file.fileMacKey, firstNodeId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (userdata *User) Stat(filename string) (info FileInfo, err error) {
+	// Get the file keys
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(userdata, filename)
+	if err != nil {
+		return info, err
+	}
+
+	// Get fileHead struct, which holds all metadata besides the owner
+	fileHead, _, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return info, err
+	}
+
+	// Retrieve owner name
+	info.Owner, err = getOwner(userdata, filename)
+	if err != nil {
+		return info, err
+	}
+
+	info.Size = fileHead.Size
+	info.NumNodes = fileHead.NumNodes
+	info.Created = fileHead.Created
+	info.Modified = fileHead.Modified
+	info.LastWriter = fileHead.LastWriter
+
+	return info, nil
+}
+
+func (userdata *User) Usage() (usage Usage, err error) {
+	return recountUsage(userdata)
+}
+
+func (userdata *User) Mkdir(path string) error {
+	if path == "" {
+		return errors.New("root directory already exists")
+	}
+
+	// Listings inside a shared folder go under the folder key at a random UUID,
+	// private ones under "path/" + username
+	parent, _ := splitPath(path)
+	dir, _, dirKey, dirMacKey, err := getDirectory(userdata, parent)
+	if err != nil {
+		return err
+	}
+	dirId := getUUID(path+"/", userdata.Username)
+	var entry DirEntry
+	entry.IsDir = true
+	if dir.Shared {
+		dirId = uuid.New()
+		entry.Node = dirId
+	}
+
+	// Add directory to its parent, which must already exist
+	err = addDirEntry(userdata, path, entry)
+	if err != nil {
+		return err
+	}
+
+	// Store empty listing
+	err = symEncThenTag(dirKey, dirMacKey, Directory{Shared: dir.Shared, UsageKey: dir.UsageKey}, dirId)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (userdata *User) ReadDir(path string) (entries []DirEntry, err error) {
+	dir, _, _, _, err := getDirectory(userdata, path)
+	if err != nil {
+		return entries, err
+	}
+
+	// Only hand back names, never the nodes and keys of shared entries
+	entries = []DirEntry{}
+	for _, entry := range dir.Entries {
+		entries = append(entries, DirEntry{Name: entry.Name, IsDir: entry.IsDir})
+	}
+	return entries, nil
 }
 
-func GetUser(username string, password string) (userdataptr *User, err error) {
-	var userdata User
-	userdataptr = &userdata
+func (userdata *User) RemoveDir(path string) error {
+	if path == "" {
+		return errors.New("cannot remove root directory")
+	}
+	_, _, err := getFileKeys(userdata, path)
+	if err == nil {
+		return errors.New("cannot remove a shared folder")
+	}
+
+	// Only empty directories can be removed
+	dir, dirId, _, _, err := getDirectory(userdata, path)
+	if err != nil {
+		return err
+	}
+	if len(dir.Entries) != 0 {
+		return errors.New("directory is not empty")
+	}
 
-	// Get user's salt from datastore
-	id := getUUID("salt", username)
-	salt, ok := userlib.DatastoreGet(id)
-	if !ok {
-		return &userdata, errors.New("user salt doesn't exist")
+	// Remove from parent listing then delete the listing itself
+	err = removeDirEntry(userdata, path)
+	if err != nil {
+		return err
 	}
+	userlib.DatastoreDelete(dirId)
 
-	// Get user's struct from datastore
-	id = getUUID("struct", username)
+	return nil
+}
 
-	// Get root key and derive enc/mac keys
-	rootKey := userlib.Argon2Key([]byte(password), salt, 16)
+func (userdata *User) Link(existing string, newName string) error {
+	target, err := resolveLink(userdata, existing)
+	if err != nil {
+		return err
+	}
 
-	encKey, err := userlib.HashKDF(rootKey, []byte("enc-key"))
+	// Only files with their own records can be linked, which rules out directories and
+	// anything inside a shared folder
+	fileKey, fileMacKey, err := getFileKeys(userdata, target)
 	if err != nil {
-		return &userdata, err
+		_, _, _, _, lookupErr := lookupFile(userdata, target)
+		if lookupErr == nil {
+			return errors.New("files inside a shared folder cannot be linked")
+		}
+		return err
 	}
-	macKey, err := userlib.HashKDF(rootKey, []byte("mac-key"))
+	fileNodeId, err := getFileNodeId(userdata, target)
 	if err != nil {
-		return &userdata, err
+		return err
 	}
-
-	// Verify/decrypt user struct then cast to User
-	userdataEntry, err := symVerifyThenDec(encKey, macKey, id)
+	fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
 	if err != nil {
-		return &userdata, err
+		return err
 	}
-	err = json.Unmarshal(userdataEntry, userdataptr)
+	if fileNode.IsDir {
+		return errors.New("path is a directory")
+	}
+	parent, _ := splitPath(newName)
+	dir, _, _, _, err := getDirectory(userdata, parent)
 	if err != nil {
-		return &userdata, err
+		return err
+	}
+	if dir.Shared {
+		return errors.New("cannot link into a shared folder")
 	}
 
-	// Add derived keys to user struct
-	userdata.encKey = encKey
-	userdata.macKey = macKey
+	// Add the new name to its directory and point it at the file's path
+	err = addDirEntry(userdata, newName, DirEntry{})
+	if err != nil {
+		return err
+	}
+	err = symEncThenTag(userdata.encKey, userdata.macKey, target, getUUID(newName+"link", userdata.Username))
+	if err != nil {
+		return err
+	}
+	links, err := getLinks(userdata, target)
+	if err != nil {
+		return err
+	}
+	err = putLinks(userdata, target, append(links, newName))
+	if err != nil {
+		return err
+	}
 
-	return userdataptr, nil
+	labels, err := fileLabels(userdata, newName)
+	if err != nil {
+		return err
+	}
+	return indexFile(userdata, newName, labels)
 }
 
-func (userdata *User) StoreFile(filename string, content []byte) (err error) {
-	// Get file node from datastore
-	fileNodeId := getUUID(filename, userdata.Username)
-	_, ok := userlib.DatastoreGet(fileNodeId)
-
-	// If filenode exists, overwrite. o.w make new file
-	if !ok {
-		// Initialize file structure
-		var fileNode FileNode
-		fileNode.Username = userdata.Username
-		fileNode.Filename = filename
-		fileNode.Children = nil
-		fileNode.FileHead = uuid.New()
-
-		var fileHead FileHead
-		contentNodeId := uuid.New()
-		fileHead.FirstNode = contentNodeId
-		fileHead.LastNode = contentNodeId
-
-		var contentNode ContentNode
-		contentNode.Contents = uuid.New()
-		contentNode.NextNode = uuid.Nil
+func (userdata *User) DeleteFile(filename string) error {
+	// A file with other names keeps them, only this one goes
+	target, err := resolveLink(userdata, filename)
+	if err != nil {
+		return err
+	}
+	if target != filename {
+		return unlinkFile(userdata, filename, target)
+	}
+	links, err := getLinks(userdata, filename)
+	if err != nil {
+		return err
+	}
+	if len(links) > 0 {
+		return promoteLink(userdata, filename, links)
+	}
 
-		// Generate File Key and File Mac Key
-		fileKey := userlib.RandomBytes(16)
-		fileMacKey, err := userlib.HashKDF(fileKey, []byte("mac-key"))
+	// A drop box has nothing to restore, the owner keeps everything dropped in it
+	dropId := getUUID(filename+"drop", userdata.Username)
+	if _, ok := userlib.DatastoreGet(dropId); ok {
+		err = removeDirEntry(userdata, filename)
 		if err != nil {
 			return err
 		}
+		userlib.DatastoreDelete(dropId)
+		return unindexFile(userdata, filename)
+	}
 
-		// Encrypt contents and store in datastore
-		err = symEncThenTag(fileKey, fileMacKey, content, contentNode.Contents)
-		if err != nil {
-			return err
-		}
-		err = symEncThenTag(fileKey, fileMacKey, contentNode, contentNodeId)
-		if err != nil {
-			return err
-		}
-		err = symEncThenTag(fileKey, fileMacKey, fileHead, fileNode.FileHead)
+	entry := TrashEntry{Id: uuid.New(), Name: filename, Deleted: time.Now()}
+
+	fileKey, fileMacKey, keysErr := getFileKeys(userdata, filename)
+	if keysErr == nil {
+		// Keep the file's records under a trash path so nothing new can take their place
+		fileNodeId, err := getFileNodeId(userdata, filename)
 		if err != nil {
 			return err
 		}
-		err = symEncThenTag(fileKey, fileMacKey, fileNode, fileNodeId)
+		fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
 		if err != nil {
 			return err
 		}
-
-		// Store file key in datastore under getUUID(filename + "key", username)
-		fileKeyId := getUUID(filename+"key", userdata.Username)
-		err = symEncThenTag(userdata.encKey, userdata.macKey, fileKey, fileKeyId)
-		if err != nil {
-			return err
+		if fileNode.IsDir {
+			return errors.New("path is a directory")
 		}
-
-		// Store username since current user is file owner
-		ownerId := getUUID(filename+"owner", userdata.Username)
-		err = symEncThenTag(userdata.encKey, userdata.macKey, userdata.Username, ownerId)
+		err = moveFile(userdata, filename, trashPath(entry.Id))
 		if err != nil {
 			return err
 		}
 	} else {
-		// Get file key and file MAC key
-		fileKey, fileMacKey, err := getFileKeys(userdata, filename)
+		// Files inside a shared folder are removed from the folder for every member
+		fileNodeId, fileKey, _, _, err := lookupFile(userdata, filename)
 		if err != nil {
 			return err
 		}
+		entry.Node = fileNodeId
+		entry.Key = fileKey
+	}
+	err = removeDirEntry(userdata, filename)
+	if err != nil {
+		return err
+	}
+	err = unindexFile(userdata, filename)
+	if err != nil {
+		return err
+	}
 
-		// Get fileHead struct
-		fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, filename, userdata.Username)
-		if err != nil {
-			return err
+	// Add to trash, purging anything past the retention period. Lookups above may have
+	// purged some already
+	trash, err := getTrash(userdata)
+	if err != nil {
+		return err
+	}
+	trash.Entries = append(trash.Entries, entry)
+	_, err = purgeTrash(userdata, trash, false)
+	return err
+}
+
+func (userdata *User) ListTrash() (entries []TrashEntry, err error) {
+	trash, err := getTrash(userdata)
+	if err != nil {
+		return entries, err
+	}
+	trash, err = purgeTrash(userdata, trash, false)
+	if err != nil {
+		return entries, err
+	}
+
+	// Keys and nodes stay private to the trash
+	entries = []TrashEntry{}
+	for _, entry := range trash.Entries {
+		entries = append(entries, TrashEntry{Id: entry.Id, Name: entry.Name, Deleted: entry.Deleted})
+	}
+	return entries, nil
+}
+
+func (userdata *User) RestoreFromTrash(id uuid.UUID) error {
+	trash, err := getTrash(userdata)
+	if err != nil {
+		return err
+	}
+	trash, err = purgeTrash(userdata, trash, false)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range trash.Entries {
+		if entry.Id != id {
+			continue
 		}
 
-		// Verify then decrypt first content node
-		contentNodeId := fileHead.FirstNode
-		contentNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNodeId)
+		// Files go back to the kind of directory they were deleted from
+		parent, _ := splitPath(entry.Name)
+		dir, _, _, _, err := getDirectory(userdata, parent)
 		if err != nil {
 			return err
 		}
-		var contentNode ContentNode
-		err = json.Unmarshal(contentNodeEntry, &contentNode)
+		if dir.Shared != (entry.Key != nil) {
+			return errors.New("file can only be restored to the kind of folder it was deleted from")
+		}
+		err = addDirEntry(userdata, entry.Name, DirEntry{Node: entry.Node, Key: entry.Key})
 		if err != nil {
 			return err
 		}
-
-		// Recursively delete content nodes in linked list
-		var nextNode ContentNode
-		for contentNode.NextNode != uuid.Nil {
-			// Verify then decrypt next node
-			nextNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNode.NextNode)
-			if err != nil {
-				return err
-			}
-			err = json.Unmarshal(nextNodeEntry, &nextNode)
+		if entry.Key == nil {
+			err = moveFile(userdata, trashPath(entry.Id), entry.Name)
 			if err != nil {
 				return err
 			}
-
-			// Delete current node then update contentNode
-			userlib.DatastoreDelete(contentNode.Contents)
-			userlib.DatastoreDelete(contentNodeId)
-			contentNodeId = contentNode.NextNode
-			contentNode = nextNode
 		}
-
-		// Create new content node and clean up
-		newContentNodeId := uuid.New()
-		fileHead.FirstNode = newContentNodeId
-		fileHead.LastNode = newContentNodeId
-
-		var newContentNode ContentNode
-		newContentNode.Contents = uuid.New()
-		newContentNode.NextNode = uuid.Nil
-
-		err = symEncThenTag(fileKey, fileMacKey, content, newContentNode.Contents)
+		labels, err := fileLabels(userdata, entry.Name)
 		if err != nil {
 			return err
 		}
-
-		err = symEncThenTag(fileKey, fileMacKey, newContentNode, newContentNodeId)
+		err = indexFile(userdata, entry.Name, labels)
 		if err != nil {
 			return err
 		}
 
-		err = symEncThenTag(fileKey, fileMacKey, fileHead, fileHeadId)
-		if err != nil {
-			return err
-		}
+		trash.Entries = append(trash.Entries[:i], trash.Entries[i+1:]...)
+		return symEncThenTag(userdata.encKey, userdata.macKey, trash, getUUID("trash", userdata.Username))
 	}
-	return nil
+	return errors.New("file is not in trash")
 }
 
-func (userdata *User) AppendToFile(filename string, content []byte) error {
-	// Get the file keys
-	fileKey, fileMacKey, err := getFileKeys(userdata, filename)
+func (userdata *User) EmptyTrash() error {
+	trash, err := getTrash(userdata)
 	if err != nil {
 		return err
 	}
+	_, err = purgeTrash(userdata, trash, true)
+	return err
+}
 
-	// Create new content node and store contents
-	var contentNode ContentNode
-	contentNode.NextNode = uuid.Nil
-	contentNodeId := uuid.New()
-
-	contentId := uuid.New()
-	contentNode.Contents = contentId
-
-	err = symEncThenTag(fileKey, fileMacKey, content, contentId)
+func (userdata *User) Search(kind string, term string) (names []string, err error) {
+	index, err := getSearchIndex(userdata)
 	if err != nil {
-		return err
+		return names, err
 	}
 
-	err = symEncThenTag(fileKey, fileMacKey, contentNode, contentNodeId)
-	if err != nil {
-		return err
+	// Match against the decrypted index, so the datastore never sees the query
+	names = []string{}
+	for _, entry := range index.Entries {
+		match := false
+		switch kind {
+		case SearchPrefix:
+			match = strings.HasPrefix(entry.Name, term)
+		case SearchSubstring:
+			match = strings.Contains(entry.Name, term)
+		case SearchTag:
+			for _, label := range entry.Labels {
+				match = match || label == term
+			}
+		default:
+			return names, errors.New("unknown search kind")
+		}
+		if match {
+			names = append(names, entry.Name)
+		}
 	}
+	sort.Strings(names)
+	return names, nil
+}
 
-	// Get fileHead struct and its UUID
-	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, filename, userdata.Username)
+func (userdata *User) RebuildIndex() error {
+	var index SearchIndex
+	err := indexTree(userdata, "", &index)
 	if err != nil {
 		return err
 	}
+	return symEncThenTag(userdata.encKey, userdata.macKey, index, getUUID("search", userdata.Username))
+}
 
-	// Add contentNode to list
-	var lastNode ContentNode
-	lastNodeId := fileHead.LastNode
-	lastNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, lastNodeId)
-	if err != nil {
-		return err
-	}
-	err = json.Unmarshal(lastNodeEntry, &lastNode)
-	if err != nil {
-		return err
-	}
-	lastNode.NextNode = contentNodeId
-	fileHead.LastNode = contentNodeId
+func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
+	invitationPtr uuid.UUID, err error) {
+	return userdata.CreateInvitationWithAccess(filename, recipientUsername, AccessWrite)
+}
 
-	// Encrypt and store fileHead and previous ContentNode in list
-	err = symEncThenTag(fileKey, fileMacKey, lastNode, lastNodeId)
-	if err != nil {
-		return err
+// Invite a recipient with either write or read-only access. The first read-only invitation
+// to a file moves it under a new key whose data is signed, which only its owner can do
+func (userdata *User) CreateInvitationWithAccess(filename string, recipientUsername string, access string) (
+	invitationPtr uuid.UUID, err error) {
+	return userdata.CreateExpiringInvitation(filename, recipientUsername, access, time.Time{}, time.Time{})
+}
+
+// Invite a recipient who has to accept by acceptBy and whose access is revoked once
+// accessUntil has passed, the next time the owner uses the file. Zero times never expire.
+// Only the owner can revoke access, so only the owner can time-box it
+func (userdata *User) CreateExpiringInvitation(filename string, recipientUsername string, access string,
+	acceptBy time.Time, accessUntil time.Time) (invitationPtr uuid.UUID, err error) {
+	if access != AccessWrite && access != AccessRead && access != AccessAppend {
+		return invitationPtr, errors.New("unknown access")
 	}
 
-	err = symEncThenTag(fileKey, fileMacKey, fileHead, fileHeadId)
+	// Linked names share through the file's path
+	filename, err = resolveLink(userdata, filename)
 	if err != nil {
-		return err
+		return invitationPtr, err
 	}
 
-	return nil
-}
+	// Sharing a private directory first turns it into a shared folder
+	_, ok := userlib.DatastoreGet(getUUID(filename+"/", userdata.Username))
+	if ok && access != AccessWrite {
+		return invitationPtr, errors.New("folders can only be shared with write access")
+	}
+	if ok {
+		err = shareDirectory(userdata, filename)
+		if err != nil {
+			return invitationPtr, err
+		}
+	}
 
-func (userdata *User) LoadFile(filename string) (content []byte, err error) {
-	// Get the file keys
+	// Retrieve ownername, file keys, and file node id
 	fileKey, fileMacKey, err := getFileKeys(userdata, filename)
 	if err != nil {
-		return content, err
+		_, _, _, _, lookupErr := lookupFile(userdata, filename)
+		if lookupErr == nil {
+			return invitationPtr, errors.New("files inside a shared folder are shared through the folder")
+		}
+		return invitationPtr, err
 	}
-
-	// Get fileHead struct and its UUID
-	fileHead, _, err := getFileHead(fileKey, fileMacKey, filename, userdata.Username)
+	writeKey, err := getWriteKey(userdata, filename)
 	if err != nil {
-		return content, err
+		return invitationPtr, err
 	}
 
-	// Verify then decrypt first content node
-	contentNodeId := fileHead.FirstNode
-	contentNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNodeId)
+	ownerName, err := getOwner(userdata, filename)
 	if err != nil {
-		return content, err
+		return invitationPtr, err
 	}
-	var contentNode ContentNode
-	err = json.Unmarshal(contentNodeEntry, &contentNode)
-	if err != nil {
-		return content, err
+	if !accessUntil.IsZero() && ownerName != userdata.Username {
+		return invitationPtr, errors.New("only the owner can give access that expires")
 	}
 
-	// Get contents of first node and add to content
-	contentEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNode.Contents)
+	// Verify file actually exists in datastore
+	fileNodeId, err := getFileNodeId(userdata, filename)
 	if err != nil {
-		return content, err
+		return invitationPtr, err
 	}
-	var contentBytes []byte
-	err = json.Unmarshal(contentEntry, &contentBytes)
+	fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
 	if err != nil {
-		return content, err
+		return invitationPtr, err
 	}
-	content = contentBytes
 
-	// Recursively add content from nodes in linked list
-	for contentNode.NextNode != uuid.Nil {
-		// Verify then decrypt next node
-		contentNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNode.NextNode)
+	// A node remembers one pending invitation per recipient, so the old one is cancelled
+	// before sending another
+	if _, ok := fileNode.Pending[recipientUsername]; ok {
+		err = userdata.CancelInvitation(filename, recipientUsername)
 		if err != nil {
-			return content, err
+			return invitationPtr, err
 		}
-		err = json.Unmarshal(contentNodeEntry, &contentNode)
+		fileNode, err = getFileNode(fileKey, fileMacKey, fileNodeId)
 		if err != nil {
-			return content, err
+			return invitationPtr, err
 		}
+	}
 
-		// Verify then decrypt content
-		contentEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNode.Contents)
+	// Readers can only pass on read access, and a file has to be signed before anyone can
+	// be given it
+	_, signed := writerVerifyKey(fileKey)
+	if access == AccessWrite {
+		err = checkWritable(fileKey, writeKey)
 		if err != nil {
-			return content, err
+			return invitationPtr, err
 		}
-		err = json.Unmarshal(contentEntry, &contentBytes)
+	} else if fileNode.IsDir {
+		return invitationPtr, errors.New("folders can only be shared with write access")
+	} else if access == AccessAppend {
+		invitationPtr, err = shareDropBox(userdata, filename, recipientUsername, acceptBy)
 		if err != nil {
-			return content, err
+			return invitationPtr, err
+		}
+		err = depositInvitation(userdata, recipientUsername, invitationPtr, filename, acceptBy)
+		if err != nil {
+			return invitationPtr, err
+		}
+		return invitationPtr, addGrant(userdata, filename, recipientUsername, accessUntil)
+	} else if !signed {
+		if ownerName != userdata.Username {
+			return invitationPtr, errors.New("only the owner can start sharing a file read-only")
+		}
+		err = rekeyShare(userdata, fileNodeId, fileNode, fileKey, fileMacKey, writeKey, true)
+		if err != nil {
+			return invitationPtr, err
+		}
+		fileKey, fileMacKey, err = getFileKeys(userdata, filename)
+		if err != nil {
+			return invitationPtr, err
+		}
+		writeKey, err = getWriteKey(userdata, filename)
+		if err != nil {
+			return invitationPtr, err
+		}
+		fileNode, err = getFileNode(fileKey, fileMacKey, fileNodeId)
+		if err != nil {
+			return invitationPtr, err
 		}
-
-		// Append to content and iterate down list
-		content = append(content, contentBytes...)
 	}
 
-	return content, nil
-}
+	// Create invitation struct and store in datastore
+	var invitation Invitation
+	invitation.Owner = ownerName
+	invitation.FileKey = fileKey
+	invitation.ParentNode = fileNodeId
+	invitation.Expires = acceptBy
+	if access == AccessWrite {
+		invitation.WriteKey = writeKey
+	}
 
-func (userdata *User) CreateInvitation(filename string, recipientUsername string) (
-	invitationPtr uuid.UUID, err error) {
-	// Retrieve ownername, file key, and file node id
-	ownerId := getUUID(filename+"owner", userdata.Username)
-	ownerNameEntry, err := symVerifyThenDec(userdata.encKey, userdata.macKey, ownerId)
+	invitationPtr = uuid.New()
+	err = asymEncThenTag(recipientUsername, userdata.DSSignKey, invitation, invitationPtr)
 	if err != nil {
 		return invitationPtr, err
 	}
-	var ownerName string
-	err = json.Unmarshal(ownerNameEntry, &ownerName)
+
+	// Add new child name to file node, pending until they accept
+	fileNode.ChildrenNames = append(fileNode.ChildrenNames, recipientUsername)
+	if fileNode.Pending == nil {
+		fileNode.Pending = make(map[string]uuid.UUID)
+	}
+	fileNode.Pending[recipientUsername] = invitationPtr
+	err = symEncThenTag(fileKey, fileMacKey, fileNode, invitation.ParentNode)
 	if err != nil {
 		return invitationPtr, err
 	}
-
-	fileKey, fileMacKey, err := getFileKeys(userdata, filename)
+	err = depositInvitation(userdata, recipientUsername, invitationPtr, filename, acceptBy)
 	if err != nil {
 		return invitationPtr, err
 	}
 
-	// Verify file actually exists in datastore
-	_, _, err = getFileHead(fileKey, fileMacKey, filename, userdata.Username)
+	return invitationPtr, addGrant(userdata, filename, recipientUsername, accessUntil)
+}
+
+// Give a recipient their own drop box for a file. Only the owner can read what's dropped
+// in it, so only the owner can hand one out
+func shareDropBox(user *User, filename string, recipientUsername string, acceptBy time.Time) (invitationPtr uuid.UUID, err error) {
+	ownerName, err := getOwner(user, filename)
 	if err != nil {
 		return invitationPtr, err
 	}
-
-	// Create invitation struct and store in datastore
-	var invitation Invitation
-	invitation.Owner = ownerName
-	invitation.FileKey = fileKey
-	invitation.ParentNode = getUUID(filename, userdata.Username)
+	if ownerName != user.Username {
+		return invitationPtr, errors.New("only the owner can share a file append-only")
+	}
+	drops, err := getDrops(user, filename)
+	if err != nil {
+		return invitationPtr, err
+	}
+	for _, drop := range drops {
+		if drop.Recipient == recipientUsername {
+			return invitationPtr, errors.New("recipient already has a drop box")
+		}
+	}
 
 	invitationPtr = uuid.New()
-	err = asymEncThenTag(recipientUsername, userdata.DSSignKey, invitation, invitationPtr)
+	drop := DropBox{Owner: user.Username, Recipient: recipientUsername, Key: userlib.RandomBytes(16), Invitation: invitationPtr}
+	invitation := Invitation{Owner: user.Username, DropKey: drop.Key, Expires: acceptBy}
+	err = asymEncThenTag(recipientUsername, user.DSSignKey, invitation, invitationPtr)
 	if err != nil {
 		return invitationPtr, err
 	}
+	return invitationPtr, putDrops(user, filename, append(drops, drop))
+}
 
-	// Add new child name to file node
-	fileNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, invitation.ParentNode)
+// Stop collecting from a recipient's drop box, keeping what they dropped before if it can
+// still be collected. The drop box is closed either way
+func closeDropBox(user *User, filename string, recipientUsername string) (err error) {
+	_ = collectContributions(user, filename)
+	drops, err := getDrops(user, filename)
 	if err != nil {
-		return invitationPtr, err
+		return err
 	}
-	var fileNode FileNode
-	err = json.Unmarshal(fileNodeEntry, &fileNode)
+	var kept []DropBox
+	for _, drop := range drops {
+		if drop.Recipient != recipientUsername {
+			kept = append(kept, drop)
+			continue
+		}
+		err = sealDropBox(user, drop)
+		if err != nil {
+			return err
+		}
+	}
+	return putDrops(user, filename, kept)
+}
+
+// Keep an append-only share's drop box and give it a name like any other file
+func acceptDropBox(user *User, invitation Invitation, filename string) (err error) {
+	parent, _ := splitPath(filename)
+	dir, _, _, _, err := getDirectory(user, parent)
 	if err != nil {
-		return invitationPtr, err
+		return err
 	}
-	fileNode.ChildrenNames = append(fileNode.ChildrenNames, recipientUsername)
-	err = symEncThenTag(fileKey, fileMacKey, fileNode, invitation.ParentNode)
+	if dir.Shared {
+		return errors.New("cannot accept an invitation inside a shared folder")
+	}
+	err = addDirEntry(user, filename, DirEntry{})
 	if err != nil {
-		return invitationPtr, err
+		return err
 	}
 
-	return invitationPtr, nil
+	drop := DropBox{Owner: invitation.Owner, Recipient: user.Username, Key: invitation.DropKey}
+	err = symEncThenTag(user.encKey, user.macKey, drop, getUUID(filename+"drop", user.Username))
+	if err != nil {
+		return err
+	}
+	return indexFile(user, filename, nil)
 }
 
 func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid.UUID, filename string) error {
 	// Check if file already exists
-	_, _, err := getFileKeys(userdata, filename)
-	if err == nil {
+	_, _, _, _, err := lookupFile(userdata, filename)
+	if err == nil || err == ErrAppendOnly {
 		return errors.New("filename already exists in namespace")
 	}
+	if err != errNotFound {
+		return err
+	}
 
 	// Retrieve and decrypt invitation
 	invitationEntry, err := asymVerifyThenDec(senderUsername, userdata.PKEDecKey, invitationPtr)
@@ -739,6 +5603,17 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 	if err != nil {
 		return err
 	}
+	if !invitation.Expires.IsZero() && time.Now().After(invitation.Expires) {
+		return errors.New("invitation has expired")
+	}
+	if invitation.DropKey != nil {
+		err = acceptDropBox(userdata, invitation, filename)
+		if err != nil {
+			return err
+		}
+		userlib.DatastoreDelete(invitationPtr)
+		return nil
+	}
 
 	fileKey := invitation.FileKey
 	fileMacKey, err := userlib.HashKDF(fileKey, []byte("mac-key"))
@@ -757,15 +5632,36 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 		return err
 	}
 
+	// Shared folders can't be nested, and their files are only shared through the folder
+	parent, _ := splitPath(filename)
+	dir, _, _, _, err := getDirectory(userdata, parent)
+	if err != nil {
+		return err
+	}
+	if dir.Shared {
+		return errors.New("cannot accept an invitation inside a shared folder")
+	}
+
+	// Add file (or shared folder mount point) to its parent directory
+	err = addDirEntry(userdata, filename, DirEntry{IsDir: parentFileNode.IsDir})
+	if err != nil {
+		return err
+	}
+
 	// Create filenode struct
 	var fileNode FileNode
 	fileNode.Username = userdata.Username
 	fileNode.Filename = filename
 	fileNode.Children = nil
 	fileNode.FileHead = parentFileNode.FileHead
+	fileNode.IsDir = parentFileNode.IsDir
+	fileNode.Parent = invitation.ParentNode
 
 	// Store new file node in datastore
-	fileNodeId := getUUID(filename, userdata.Username)
+	fileNodeId, err := newFileNodeId(userdata, filename)
+	if err != nil {
+		return err
+	}
 	err = symEncThenTag(fileKey, fileMacKey, fileNode, fileNodeId)
 	if err != nil {
 		return err
@@ -773,6 +5669,9 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 
 	// Add new file node to tree
 	parentFileNode.Children = append(parentFileNode.Children, fileNodeId)
+	if parentFileNode.Pending[userdata.Username] == invitationPtr {
+		delete(parentFileNode.Pending, userdata.Username)
+	}
 	err = symEncThenTag(fileKey, fileMacKey, parentFileNode, invitation.ParentNode)
 	if err != nil {
 		return err
@@ -792,28 +5691,269 @@ func (userdata *User) AcceptInvitation(senderUsername string, invitationPtr uuid
 		return err
 	}
 
+	// Writers of a signed file keep its write key with the file key, and add their node to
+	// its writer record so they keep it after revocations
+	if invitation.WriteKey != nil {
+		writeKeyId := getUUID(filename+"writekey", userdata.Username)
+		err = symEncThenTag(userdata.encKey, userdata.macKey, invitation.WriteKey, writeKeyId)
+		if err != nil {
+			return err
+		}
+		writers, err := getWriters(fileKey, fileMacKey)
+		if err != nil {
+			return err
+		}
+		writers.Nodes = append(writers.Nodes, fileNodeId)
+		err = putWriters(fileKey, fileMacKey, invitation.WriteKey, writers)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Delete invitation from datastore
 	userlib.DatastoreDelete(invitationPtr)
 
+	// Add the file, or every file in the shared folder, to the search index
+	if fileNode.IsDir {
+		index, err := getSearchIndex(userdata)
+		if err != nil {
+			return err
+		}
+		err = indexTree(userdata, filename, &index)
+		if err != nil {
+			return err
+		}
+		return symEncThenTag(userdata.encKey, userdata.macKey, index, getUUID("search", userdata.Username))
+	}
+	labels, err := fileLabels(userdata, filename)
+	if err != nil {
+		return err
+	}
+	return indexFile(userdata, filename, labels)
+}
+
+// List invitations waiting in the user's inbox, oldest first. Pointers to invitations that
+// were accepted, cancelled or have expired are left out, and cleared once nothing before
+// them is waiting
+func (userdata *User) ListInvitations() (entries []InboxEntry, err error) {
+	start, err := getInboxStart(userdata)
+	if err != nil {
+		return entries, err
+	}
+	newStart := start
+	now := time.Now()
+	for n := start; ; n++ {
+		slotId := inboxSlot(userdata.Username, n)
+		if _, ok := userlib.DatastoreGet(slotId); !ok {
+			break
+		}
+
+		// Anyone can write a slot, so entries that aren't signed by their sender are skipped
+		var entry InboxEntry
+		content, err := asymDec(userdata.PKEDecKey, slotId)
+		if err == nil {
+			err = json.Unmarshal(content, &entry)
+		}
+		if err == nil {
+			content, err = asymVerifyThenDec(entry.Sender, userdata.PKEDecKey, slotId)
+		}
+		if err == nil {
+			entry = InboxEntry{}
+			err = json.Unmarshal(content, &entry)
+		}
+		_, waiting := userlib.DatastoreGet(entry.Invitation)
+		waiting = waiting && (entry.Expires.IsZero() || now.Before(entry.Expires))
+		if err == nil && waiting {
+			entries = append(entries, entry)
+			continue
+		}
+		// Cleared slots are emptied rather than deleted, so a sender without a good hint
+		// never fills one the user has already read past
+		if newStart == n {
+			userlib.DatastoreSet(slotId, []byte{})
+			newStart = n + 1
+		}
+	}
+
+	if newStart != start {
+		err = symEncThenTag(userdata.encKey, userdata.macKey, newStart, getUUID("inbox", userdata.Username))
+		if err != nil {
+			return entries, err
+		}
+		err = putInboxHint(userdata, newStart)
+		if err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+// Turn down an invitation. It's deleted, and the sender's file stops listing the user as
+// invited without the re-keying a revocation would need. If the file was re-keyed since it
+// was sent the invitation is deleted all the same, and the sender's file keeps listing the
+// user until they cancel or revoke it
+func (userdata *User) DeclineInvitation(senderUsername string, invitationPtr uuid.UUID) error {
+	invitationEntry, err := asymVerifyThenDec(senderUsername, userdata.PKEDecKey, invitationPtr)
+	if err != nil {
+		return err
+	}
+	var invitation Invitation
+	err = json.Unmarshal(invitationEntry, &invitation)
+	if err != nil {
+		return err
+	}
+
+	// The owner's drop boxes are private, so they're left a signed note to close it
+	if invitation.DropKey != nil {
+		id, err := declinedId(invitation.DropKey)
+		if err != nil {
+			return err
+		}
+		err = asymEncThenTag(invitation.Owner, userdata.DSSignKey, invitationPtr, id)
+		if err != nil {
+			return err
+		}
+		userlib.DatastoreDelete(invitationPtr)
+		return nil
+	}
+
+	fileKey := invitation.FileKey
+	fileMacKey, err := userlib.HashKDF(fileKey, []byte("mac-key"))
+	if err != nil {
+		return err
+	}
+	parentFileNode, err := getFileNode(fileKey, fileMacKey, invitation.ParentNode)
+	if err != nil {
+		userlib.DatastoreDelete(invitationPtr)
+		return nil
+	}
+
+	// Only take the user off the sender's list if this invitation is what put them there
+	if parentFileNode.Pending[userdata.Username] == invitationPtr {
+		delete(parentFileNode.Pending, userdata.Username)
+		for i, name := range parentFileNode.ChildrenNames {
+			if name == userdata.Username {
+				parentFileNode.ChildrenNames = append(parentFileNode.ChildrenNames[:i], parentFileNode.ChildrenNames[i+1:]...)
+				break
+			}
+		}
+		err = symEncThenTag(fileKey, fileMacKey, parentFileNode, invitation.ParentNode)
+		if err != nil {
+			return err
+		}
+	}
+	userlib.DatastoreDelete(invitationPtr)
 	return nil
 }
 
+// Withdraw an invitation that hasn't been accepted. The recipient never got anything but the
+// invitation, so deleting it is enough and nothing is re-keyed
+func (userdata *User) CancelInvitation(filename string, recipientUsername string) error {
+	filename, err := resolveLink(userdata, filename)
+	if err != nil {
+		return err
+	}
+
+	// Drop boxes are pending for as long as their invitation is still there, unless it was declined
+	drops, err := getDrops(userdata, filename)
+	if err != nil {
+		return err
+	}
+	drops, err = closeDeclined(userdata, filename, drops)
+	if err != nil {
+		return err
+	}
+	for i, drop := range drops {
+		if drop.Recipient != recipientUsername {
+			continue
+		}
+		if _, ok := userlib.DatastoreGet(drop.Invitation); !ok {
+			return errors.New("invitation was already accepted")
+		}
+		userlib.DatastoreDelete(drop.Invitation)
+		err = putDrops(userdata, filename, append(drops[:i], drops[i+1:]...))
+		if err != nil {
+			return err
+		}
+		return removeGrant(userdata, filename, recipientUsername)
+	}
+
+	fileKey, fileMacKey, err := getFileKeys(userdata, filename)
+	if err != nil {
+		return err
+	}
+	fileNodeId, err := getFileNodeId(userdata, filename)
+	if err != nil {
+		return err
+	}
+	fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
+	if err != nil {
+		return err
+	}
+	invitationPtr, ok := fileNode.Pending[recipientUsername]
+	if !ok {
+		return errors.New("no pending invitation for recipient")
+	}
+
+	// Delete the invitation and forget the recipient was ever invited
+	userlib.DatastoreDelete(invitationPtr)
+	delete(fileNode.Pending, recipientUsername)
+	for i, name := range fileNode.ChildrenNames {
+		if name == recipientUsername {
+			fileNode.ChildrenNames = append(fileNode.ChildrenNames[:i], fileNode.ChildrenNames[i+1:]...)
+			break
+		}
+	}
+	err = symEncThenTag(fileKey, fileMacKey, fileNode, fileNodeId)
+	if err != nil {
+		return err
+	}
+	return removeGrant(userdata, filename, recipientUsername)
+}
+
 func (userdata *User) RevokeAccess(filename string, recipientUsername string) error {
-	// Make a new file key
-	newFileKey := userlib.RandomBytes(16)
-	newFileMacKey, err := userlib.HashKDF(newFileKey, []byte("mac-key"))
+	// Get the old file keys, through the file's path if filename is a linked name
+	filename, err := resolveLink(userdata, filename)
+	if err != nil {
+		return err
+	}
+
+	// Access that was going to expire has now ended early
+	err = removeGrant(userdata, filename, recipientUsername)
 	if err != nil {
 		return err
 	}
 
-	// Get the old file keys
+	// Append-only recipients never had the file key, so closing their drop box is enough
+	drops, err := getDrops(userdata, filename)
+	if err != nil {
+		return err
+	}
+	for _, drop := range drops {
+		if drop.Recipient == recipientUsername {
+			return closeDropBox(userdata, filename, recipientUsername)
+		}
+	}
 	fileKey, fileMacKey, err := getFileKeys(userdata, filename)
 	if err != nil {
 		return err
 	}
+	writeKey, err := getWriteKey(userdata, filename)
+	if err != nil {
+		return err
+	}
+
+	// Readers can't rewrite the file under a new key
+	err = checkWritable(fileKey, writeKey)
+	if err != nil {
+		return err
+	}
 
 	// Get file node
-	fileNodeId := getUUID(filename, userdata.Username)
+	fileNodeId, err := getFileNodeId(userdata, filename)
+	if err != nil {
+		return err
+	}
 	fileNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, fileNodeId)
 	if err != nil {
 		return err
@@ -832,7 +5972,7 @@ func (userdata *User) RevokeAccess(filename string, recipientUsername string) er
 		}
 	}
 	if len(newChildrenNames) == len(fileNode.ChildrenNames) {
-		return errors.New("recipient was not shared with")
+		return errNotShared
 	}
 
 	// Remove recipient from tree
@@ -854,125 +5994,97 @@ func (userdata *User) RevokeAccess(filename string, recipientUsername string) er
 		}
 	}
 	fileNode.Children = newChildren
+
+	// An invitation they haven't accepted yet can't be accepted now
+	if invitationPtr, ok := fileNode.Pending[recipientUsername]; ok {
+		userlib.DatastoreDelete(invitationPtr)
+		delete(fileNode.Pending, recipientUsername)
+	}
 	err = symEncThenTag(fileKey, fileMacKey, fileNode, fileNodeId)
 	if err != nil {
 		return err
 	}
 
-	// Get fileHead struct
-	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, filename, userdata.Username)
-	if err != nil {
-		return err
-	}
+	// Remove all revoked users from file tree by moving everyone else under a new key
+	_, signed := writerVerifyKey(fileKey)
+	return rekeyShare(userdata, fileNodeId, fileNode, fileKey, fileMacKey, writeKey, signed)
+}
 
-	// Verify then decrypt first content node
-	contentNodeId := fileHead.FirstNode
-	contentNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNodeId)
+// Who has a file and who invited them, as far down from the user as they can see. Owners
+// see the whole tree and their drop boxes, recipients only the users they invited and so on
+func (userdata *User) GetShareTree(filename string) (tree ShareNode, err error) {
+	filename, err = resolveLink(userdata, filename)
 	if err != nil {
-		return err
+		return tree, err
+	}
+	fileNodeId, fileKey, fileMacKey, _, err := lookupFile(userdata, filename)
+	if err == ErrAppendOnly {
+		return ShareNode{Username: userdata.Username, Access: AccessAppend}, nil
 	}
-	var contentNode ContentNode
-	err = json.Unmarshal(contentNodeEntry, &contentNode)
 	if err != nil {
-		return err
+		return tree, err
 	}
 
-	// Setup new file head and start of content node chain
-	var newFileHead FileHead
-	newFileHeadId := uuid.New()
-	newFileHead.FirstNode = uuid.New()
-
-	var newContentNode ContentNode
-	newContentNode.Contents = uuid.New()
-	newContentNode.NextNode = uuid.New()
-
-	// Recursively delete content nodes in linked list while copying to new list
-	var nextNode ContentNode
-	var content []byte
-	newContentNodeId := newFileHead.FirstNode
-	for contentNode.NextNode != uuid.Nil {
-		// Get content from old content node then store in new one
-		contentEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNode.Contents)
-		if err != nil {
-			return err
-		}
-		err = json.Unmarshal(contentEntry, &content)
-		if err != nil {
-			return err
-		}
-		err = symEncThenTag(newFileKey, newFileMacKey, content, newContentNode.Contents)
-		if err != nil {
-			return err
-		}
-
-		// Encrypt then tag new content node
-		err = symEncThenTag(newFileKey, newFileMacKey, newContentNode, newContentNodeId)
-		if err != nil {
-			return err
-		}
-
-		// Update vars for next iteration
-		newContentNodeId = newContentNode.NextNode
-		newContentNode.Contents = uuid.New()
-		newContentNode.NextNode = uuid.New()
-
-		// Verify then decrypt next node in old chain
-		nextNodeEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNode.NextNode)
+	// Only the nodes in a signed file's writer record can write it
+	var writers map[uuid.UUID]bool
+	if _, signed := writerVerifyKey(fileKey); signed {
+		fileWriters, err := getWriters(fileKey, fileMacKey)
 		if err != nil {
-			return err
+			return tree, err
 		}
-		err = json.Unmarshal(nextNodeEntry, &nextNode)
-		if err != nil {
-			return err
+		writers = make(map[uuid.UUID]bool)
+		for _, id := range fileWriters.Nodes {
+			writers[id] = true
 		}
-
-		// Delete current node then update contentNode
-		userlib.DatastoreDelete(contentNode.Contents)
-		userlib.DatastoreDelete(contentNodeId)
-		contentNodeId = contentNode.NextNode
-		contentNode = nextNode
 	}
-
-	// Get content from old content node then store in new one
-	contentEntry, err := symVerifyThenDec(fileKey, fileMacKey, contentNode.Contents)
+	tree, err = shareSubtree(fileKey, fileMacKey, writers, fileNodeId)
 	if err != nil {
-		return err
+		return tree, err
 	}
-	err = json.Unmarshal(contentEntry, &content)
+
+	// Drop boxes are pending for as long as their invitation is still there
+	drops, err := getDrops(userdata, filename)
 	if err != nil {
-		return err
+		return tree, err
 	}
-	err = symEncThenTag(newFileKey, newFileMacKey, content, newContentNode.Contents)
+	drops, err = closeDeclined(userdata, filename, drops)
 	if err != nil {
-		return err
+		return tree, err
 	}
-
-	// Encrypt then tag new content node
-	err = symEncThenTag(newFileKey, newFileMacKey, newContentNode, newContentNodeId)
-	if err != nil {
-		return err
+	for _, drop := range drops {
+		_, pending := userlib.DatastoreGet(drop.Invitation)
+		tree.Children = append(tree.Children, ShareNode{Username: drop.Recipient, Access: AccessAppend, Pending: pending})
 	}
+	return tree, nil
+}
 
-	// Encrypt then tag last new content node
-	newContentNode.NextNode = uuid.Nil
-	err = symEncThenTag(newFileKey, newFileMacKey, newContentNode, newContentNodeId)
+// Share tree below a file node, in the order its children were invited. Nodes can write if
+// they're in writers, or always if it's nil
+func shareSubtree(fileKey []byte, fileMacKey []byte, writers map[uuid.UUID]bool, fileNodeId uuid.UUID) (tree ShareNode, err error) {
+	fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
 	if err != nil {
-		return err
+		return tree, err
 	}
-
-	// Encrypt then tag new file head, delete old one
-	newFileHead.LastNode = newContentNodeId
-	err = symEncThenTag(newFileKey, newFileMacKey, newFileHead, newFileHeadId)
-	if err != nil {
-		return err
+	tree.Username = fileNode.Username
+	tree.Access = AccessWrite
+	if writers != nil && !writers[fileNodeId] {
+		tree.Access = AccessRead
 	}
-	userlib.DatastoreDelete(fileHeadId)
 
-	// Remove all revoked users from file tree and give others the new file head
-	err = cleanFileTree(fileKey, newFileKey, fileNodeId, newFileHeadId, userdata.DSSignKey)
-	if err != nil {
-		return err
+	accepted := make(map[string]ShareNode)
+	for _, id := range fileNode.Children {
+		child, err := shareSubtree(fileKey, fileMacKey, writers, id)
+		if err != nil {
+			return tree, err
+		}
+		accepted[child.Username] = child
 	}
-
-	return nil
+	for _, name := range fileNode.ChildrenNames {
+		if child, ok := accepted[name]; ok {
+			tree.Children = append(tree.Children, child)
+		} else if _, ok := fileNode.Pending[name]; ok {
+			tree.Children = append(tree.Children, ShareNode{Username: name, Pending: true})
+		}
+	}
+	return tree, nil
 }
@@ -1,16 +1,19 @@
 package client_test
 
-// You MUST NOT change these default imports.  ANY additional imports may
-// break the autograder and everyone will be sad.
+// You MUST NOT change these default imports.  Additional imports are limited
+// to the standard library (io, strconv, strings and time below), anything
+// else may break the autograder and everyone will be sad.
 
 import (
 	// Some imports use an underscore to prevent the compiler from complaining
 	// about unused imports.
 	_ "encoding/hex"
 	_ "errors"
-	_ "strconv"
-	_ "strings"
+	"io"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	// A "dot" import is used here so that the functions in the ginko and gomega
 	// modules can be used without an identifier. For example, Describe() and
@@ -19,6 +22,7 @@ import (
 	. "github.com/onsi/gomega"
 
 	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
 
 	"github.com/cs161-staff/project2-starter-code/client"
 )
@@ -37,6 +41,14 @@ const contentOne = "Bitcoin is Nick's favorite "
 const contentTwo = "digital "
 const contentThree = "cryptocurrency!"
 
+// Total size of everything in the datastore, to measure what a write adds
+func datastoreBytes() (total int) {
+	for _, value := range userlib.DatastoreGetMap() {
+		total += len(value)
+	}
+	return total
+}
+
 // ================================================
 // Describe(...) blocks help you organize your tests
 // into functional categories. They can be nested into
@@ -50,7 +62,7 @@ var _ = Describe("Client Tests", func() {
 	var alice *client.User
 	var bob *client.User
 	var charles *client.User
-	// var doris *client.User
+	var doris *client.User
 	// var eve *client.User
 	// var frank *client.User
 	// var grace *client.User
@@ -440,6 +452,3597 @@ var _ = Describe("Client Tests", func() {
 
 	})
 
+	Describe("Stat Tests", func() {
+
+		Specify("Stat reports size, node count, owner and last writer", func() {
+			userlib.DebugMsg("Initializing users Alice and Bob.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice storing file data: %s", contentOne)
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.Size).To(Equal(len(contentOne)))
+			Expect(info.NumNodes).To(Equal(1))
+			Expect(info.Owner).To(Equal("alice"))
+			Expect(info.LastWriter).To(Equal("alice"))
+			created := info.Created
+
+			userlib.DebugMsg("Sharing with Bob, who appends: %s", contentTwo)
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Both users see the updated metadata.")
+			info, err = alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.Size).To(Equal(len(contentOne + contentTwo)))
+			Expect(info.NumNodes).To(Equal(2))
+			Expect(info.LastWriter).To(Equal("bob"))
+			Expect(info.Created).To(Equal(created))
+			Expect(info.Modified.Before(created)).To(BeFalse())
+
+			info, err = bob.Stat(bobFile)
+			Expect(err).To(BeNil())
+			Expect(info.Owner).To(Equal("alice"))
+			Expect(info.Size).To(Equal(len(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Overwriting resets size but keeps creation time.")
+			err = alice.StoreFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			info, err = bob.Stat(bobFile)
+			Expect(err).To(BeNil())
+			Expect(info.Size).To(Equal(len(contentThree)))
+			Expect(info.NumNodes).To(Equal(1))
+			Expect(info.LastWriter).To(Equal("alice"))
+			Expect(info.Created).To(Equal(created))
+
+			userlib.DebugMsg("Stat on a non-existant file errors.")
+			_, err = alice.Stat(testFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Stat does not download file content", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			bigContent := make([]byte, 100000)
+			err = alice.StoreFile(aliceFile, bigContent)
+			Expect(err).To(BeNil())
+
+			userlib.DatastoreResetBandwidth()
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.Size).To(Equal(len(bigContent)))
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", 10000))
+		})
+
+	})
+
+	Describe("Directory Tests", func() {
+
+		Specify("Mkdir/ReadDir/RemoveDir with path-based filenames", func() {
+			userlib.DebugMsg("Initializing user Alice.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Root starts out empty.")
+			entries, err := alice.ReadDir("")
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+
+			userlib.DebugMsg("Storing into a missing directory fails.")
+			err = alice.StoreFile("docs/"+aliceFile, []byte(contentOne))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Creating docs and docs/old.")
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("docs/old")
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("docs")
+			Expect(err).ToNot(BeNil())
+			err = alice.Mkdir("missing/dir")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Storing and loading files by path.")
+			err = alice.StoreFile("docs/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("docs/old/"+aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile("docs/"+aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile("docs/" + aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentThree)))
+			data, err = alice.LoadFile("docs/old/" + aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			entries, err = alice.ReadDir("")
+			Expect(err).To(BeNil())
+			Expect(entries).To(Equal([]client.DirEntry{{Name: "docs", IsDir: true}}))
+			entries, err = alice.ReadDir("docs")
+			Expect(err).To(BeNil())
+			Expect(entries).To(ConsistOf(
+				client.DirEntry{Name: "old", IsDir: true},
+				client.DirEntry{Name: aliceFile, IsDir: false}))
+
+			userlib.DebugMsg("A file and a directory cannot share a name.")
+			err = alice.StoreFile("docs/old", []byte(contentOne))
+			Expect(err).ToNot(BeNil())
+			err = alice.Mkdir("docs/" + aliceFile)
+			Expect(err).ToNot(BeNil())
+			_, err = alice.ReadDir("docs/" + aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Only empty directories can be removed.")
+			err = alice.RemoveDir("docs")
+			Expect(err).ToNot(BeNil())
+			err = alice.Mkdir("docs/empty")
+			Expect(err).To(BeNil())
+			err = alice.RemoveDir("docs/empty")
+			Expect(err).To(BeNil())
+			_, err = alice.ReadDir("docs/empty")
+			Expect(err).ToNot(BeNil())
+			err = alice.RemoveDir("")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Another session sees the same tree.")
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			entries, err = aliceLaptop.ReadDir("docs/old")
+			Expect(err).To(BeNil())
+			Expect(entries).To(Equal([]client.DirEntry{{Name: aliceFile, IsDir: false}}))
+		})
+
+		Specify("Accepting an invitation into a directory", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob cannot accept into a missing directory.")
+			err = bob.AcceptInvitation("alice", invite, "shared/"+bobFile)
+			Expect(err).ToNot(BeNil())
+
+			err = bob.Mkdir("shared")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "shared/"+bobFile)
+			Expect(err).To(BeNil())
+
+			entries, err := bob.ReadDir("shared")
+			Expect(err).To(BeNil())
+			Expect(entries).To(Equal([]client.DirEntry{{Name: bobFile, IsDir: false}}))
+			data, err := bob.LoadFile("shared/" + bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("Stores that can't create or overwrite the file write nothing", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			err = alice.StoreFile("docs", []byte(contentOne))
+			Expect(err).ToNot(BeNil())
+			err = alice.StoreFile("missing/"+aliceFile, []byte(contentOne))
+			Expect(err).ToNot(BeNil())
+			Expect(userlib.DatastoreGetMap()).To(Equal(before))
+
+			userlib.DebugMsg("A file whose records were tampered with isn't stored over.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			for key, value := range userlib.DatastoreGetMap() {
+				if _, ok := before[key]; !ok {
+					tampered := append([]byte{}, value...)
+					tampered[len(tampered)-1] ^= 1
+					userlib.DatastoreSet(key, tampered)
+				}
+			}
+			size := len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			Expect(userlib.DatastoreGetMap()).To(HaveLen(size))
+		})
+
+		Specify("Directory listings reveal no names to the datastore", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("secretProject")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("secretProject/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			for _, value := range userlib.DatastoreGetMap() {
+				Expect(string(value)).ToNot(ContainSubstring("secretProject"))
+				Expect(string(value)).ToNot(ContainSubstring(aliceFile))
+			}
+		})
+
+	})
+
+	Describe("Shared Folder Tests", func() {
+
+		Specify("Files added by any member are visible to all members", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, and Charles.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice creates team/ with a file and a subdirectory.")
+			err = alice.Mkdir("team")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("team/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("team/notes")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares team/ with Bob, who mounts it as shared/.")
+			invite, err := alice.CreateInvitation("team", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "shared")
+			Expect(err).To(BeNil())
+
+			data, err := bob.LoadFile("shared/" + aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			entries, err := bob.ReadDir("")
+			Expect(err).To(BeNil())
+			Expect(entries).To(Equal([]client.DirEntry{{Name: "shared", IsDir: true}}))
+
+			userlib.DebugMsg("Bob adds a file after accepting, Alice sees it.")
+			err = bob.StoreFile("shared/notes/"+bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile("team/notes/" + bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("Alice appends to Bob's file, Bob sees it.")
+			err = alice.AppendToFile("team/notes/"+bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile("shared/notes/" + bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo + contentThree)))
+
+			info, err := bob.Stat("shared/notes/" + bobFile)
+			Expect(err).To(BeNil())
+			Expect(info.Owner).To(Equal("alice"))
+			Expect(info.LastWriter).To(Equal("alice"))
+
+			userlib.DebugMsg("Bob re-shares the folder with Charles, who sees everything.")
+			invite, err = bob.CreateInvitation("shared", "charles")
+			Expect(err).To(BeNil())
+			err = charles.Mkdir("mounts")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, "mounts/team")
+			Expect(err).To(BeNil())
+
+			entries, err = charles.ReadDir("mounts/team")
+			Expect(err).To(BeNil())
+			Expect(entries).To(ConsistOf(
+				client.DirEntry{Name: aliceFile, IsDir: false},
+				client.DirEntry{Name: "notes", IsDir: true}))
+			data, err = charles.LoadFile("mounts/team/notes/" + bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo + contentThree)))
+
+			userlib.DebugMsg("Charles makes a directory, Alice and Bob see it.")
+			err = charles.Mkdir("mounts/team/drafts")
+			Expect(err).To(BeNil())
+			err = charles.StoreFile("mounts/team/drafts/"+charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile("team/drafts/" + charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			entries, err = bob.ReadDir("shared/drafts")
+			Expect(err).To(BeNil())
+			Expect(entries).To(Equal([]client.DirEntry{{Name: charlesFile, IsDir: false}}))
+		})
+
+		Specify("Revoking a folder cuts off every file inside it", func() {
+			userlib.DebugMsg("Initializing users Alice, Bob, Charles, and Doris.")
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("team")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("team/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice shares with Bob and Doris, Bob shares with Charles.")
+			invite, err := alice.CreateInvitation("team", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "team")
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation("team", "doris")
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, "team")
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation("team", "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, "team")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Doris creates a file after Bob was invited.")
+			err = doris.StoreFile("team/"+bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile("team/" + bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("Alice revokes Bob's access to the folder.")
+			err = alice.RevokeAccess("team", "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob and Charles lose access to every file, old and new.")
+			_, err = bob.LoadFile("team/" + aliceFile)
+			Expect(err).ToNot(BeNil())
+			_, err = bob.LoadFile("team/" + bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = bob.ReadDir("team")
+			Expect(err).ToNot(BeNil())
+			err = bob.StoreFile("team/"+charlesFile, []byte(contentThree))
+			Expect(err).ToNot(BeNil())
+			_, err = charles.LoadFile("team/" + bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice and Doris keep access, including to new files.")
+			data, err = alice.LoadFile("team/" + bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			err = doris.AppendToFile("team/"+aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("team/"+charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = doris.LoadFile("team/" + charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			data, err = alice.LoadFile("team/" + aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Shared folder error checks", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("team")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("team/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Folders containing individually shared files can't be shared.")
+			invite, err := alice.CreateInvitation("team/"+aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation("team", "bob")
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFile("team/" + aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Bob can't accept into a shared folder.")
+			err = alice.Mkdir("other")
+			Expect(err).To(BeNil())
+			folderInvite, err := alice.CreateInvitation("other", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", folderInvite, "other")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "other/"+bobFile)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Files in a shared folder are shared through the folder.")
+			err = alice.StoreFile("other/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation("other/"+aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Loading a folder or removing a mount point fails.")
+			_, err = bob.LoadFile("other")
+			Expect(err).ToNot(BeNil())
+			err = bob.RemoveDir("other")
+			Expect(err).ToNot(BeNil())
+			_, err = alice.CreateInvitation("", "bob")
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("ReadAt Tests", func() {
+
+		Specify("ReadAt returns the requested range across content nodes", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			full := contentOne + contentTwo + contentThree
+
+			userlib.DebugMsg("Checking every range against LoadFile.")
+			for offset := 0; offset <= len(full); offset++ {
+				for end := offset; end <= len(full); end += 7 {
+					data, err := alice.ReadAt(aliceFile, offset, end-offset)
+					Expect(err).To(BeNil())
+					Expect(string(data)).To(Equal(full[offset:end]))
+				}
+			}
+
+			userlib.DebugMsg("Reads past the end come back short.")
+			data, err := alice.ReadAt(aliceFile, len(full)-3, 100)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal(full[len(full)-3:]))
+
+			userlib.DebugMsg("Invalid ranges error.")
+			_, err = alice.ReadAt(aliceFile, len(full)+1, 1)
+			Expect(err).ToNot(BeNil())
+			_, err = alice.ReadAt(aliceFile, -1, 1)
+			Expect(err).ToNot(BeNil())
+			_, err = alice.ReadAt(bobFile, 0, 1)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("ReadAt keeps working across index pages and revocation", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte("0"))
+			Expect(err).To(BeNil())
+			full := "0"
+			for i := 1; i < 300; i++ {
+				next := string(rune('a' + i%26))
+				err = alice.AppendToFile(aliceFile, []byte(next))
+				Expect(err).To(BeNil())
+				full += next
+			}
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.ReadAt(bobFile, 250, 20)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal(full[250:270]))
+
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			for _, offset := range []int{0, 127, 128, 129, 255, 256, 299} {
+				data, err = alice.ReadAt(aliceFile, offset, 5)
+				Expect(err).To(BeNil())
+				end := offset + 5
+				if end > len(full) {
+					end = len(full)
+				}
+				Expect(string(data)).To(Equal(full[offset:end]))
+			}
+			_, err = bob.ReadAt(bobFile, 0, 1)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Overwriting rebuilds the index.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err = alice.ReadAt(aliceFile, 8, 2)
+			Expect(err).To(BeNil())
+			Expect(string(data)).To(Equal(contentOne[8:10]))
+		})
+
+		Specify("ReadAt bandwidth scales with the requested range", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			chunk := make([]byte, 10000)
+			err = alice.StoreFile(aliceFile, chunk)
+			Expect(err).To(BeNil())
+			for i := 0; i < 20; i++ {
+				err = alice.AppendToFile(aliceFile, chunk)
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DatastoreResetBandwidth()
+			data, err := alice.ReadAt(aliceFile, 21*len(chunk)-1000, 1000)
+			Expect(err).To(BeNil())
+			Expect(data).To(HaveLen(1000))
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", 3*len(chunk)))
+		})
+
+	})
+
+	Describe("Streaming Tests", func() {
+
+		AfterEach(func() {
+			client.ObjectQuota = 0
+		})
+
+		Specify("Writers chunk data into content nodes and readers stream it back", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Writing 200000 bytes in small pieces.")
+			expected := make([]byte, 0, 200000)
+			writer, err := alice.CreateWriter(aliceFile)
+			Expect(err).To(BeNil())
+			for i := 0; i < 200; i++ {
+				piece := make([]byte, 1000)
+				for j := range piece {
+					piece[j] = byte(i + j)
+				}
+				n, err := writer.Write(piece)
+				Expect(err).To(BeNil())
+				Expect(n).To(Equal(len(piece)))
+				expected = append(expected, piece...)
+			}
+			Expect(writer.Close()).To(BeNil())
+			_, err = writer.Write([]byte(contentOne))
+			Expect(err).ToNot(BeNil())
+
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.Size).To(Equal(len(expected)))
+			Expect(info.NumNodes).To(Equal(4))
+
+			userlib.DebugMsg("Reading it back through a reader.")
+			reader, err := alice.OpenReader(aliceFile)
+			Expect(err).To(BeNil())
+			data, err := io.ReadAll(reader)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			Expect(reader.Close()).To(BeNil())
+			_, err = reader.Read(make([]byte, 1))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Appending through a writer.")
+			writer, err = alice.AppendWriter(aliceFile)
+			Expect(err).To(BeNil())
+			_, err = writer.Write([]byte(contentOne))
+			Expect(err).To(BeNil())
+			Expect(writer.Close()).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(append(expected, []byte(contentOne)...)))
+
+			userlib.DebugMsg("CreateWriter replaces existing content.")
+			writer, err = alice.CreateWriter(aliceFile)
+			Expect(err).To(BeNil())
+			_, err = writer.Write([]byte(contentTwo))
+			Expect(err).To(BeNil())
+			Expect(writer.Close()).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			info, err = alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(1))
+
+			userlib.DebugMsg("Streams on missing files error.")
+			_, err = alice.OpenReader(bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = alice.AppendWriter(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Writes that fail partway report how much was written", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			content := make([]byte, 3*client.ChunkSize+10)
+			for i := range content {
+				content[i] = byte(i)
+			}
+			// The empty file CreateWriter starts with is kept as a version, which takes a node
+			client.ObjectQuota = 3
+			writer, err := alice.CreateWriter(aliceFile)
+			Expect(err).To(BeNil())
+			n, err := writer.Write(content)
+			Expect(err).To(Equal(client.ErrQuotaExceeded))
+			Expect(n).To(Equal(2 * client.ChunkSize))
+
+			userlib.DebugMsg("The rest can be written again once there's room.")
+			client.ObjectQuota = 0
+			n, err = writer.Write(content[n:])
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(client.ChunkSize + 10))
+			Expect(writer.Close()).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+		})
+
+		Specify("Readers only download content as it is read", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			chunk := make([]byte, 10000)
+			err = alice.StoreFile(aliceFile, chunk)
+			Expect(err).To(BeNil())
+			for i := 0; i < 20; i++ {
+				err = alice.AppendToFile(aliceFile, chunk)
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DatastoreResetBandwidth()
+			reader, err := alice.OpenReader(aliceFile)
+			Expect(err).To(BeNil())
+			n, err := reader.Read(make([]byte, 100))
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(100))
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", 2*len(chunk)))
+		})
+
+	})
+
+	Describe("Chunking Tests", func() {
+
+		var defaultChunkSize int
+
+		BeforeEach(func() {
+			defaultChunkSize = client.ChunkSize
+		})
+
+		AfterEach(func() {
+			client.ChunkSize = defaultChunkSize
+		})
+
+		Specify("StoreFile and AppendToFile split content into bounded chunks", func() {
+			client.ChunkSize = 10000
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			content := make([]byte, 105000)
+			for i := range content {
+				content[i] = byte(i)
+			}
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(11))
+			Expect(info.Size).To(Equal(len(content)))
+
+			userlib.DebugMsg("No datastore entry holds much more than a chunk.")
+			for _, value := range userlib.DatastoreGetMap() {
+				Expect(len(value)).To(BeNumerically("<", 3*client.ChunkSize))
+			}
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			data, err = alice.ReadAt(aliceFile, 29990, 10020)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content[29990:40010]))
+
+			userlib.DebugMsg("Appends are chunked too.")
+			err = alice.AppendToFile(aliceFile, content[:25000])
+			Expect(err).To(BeNil())
+			info, err = alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(14))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(append(append([]byte{}, content...), content[:25000]...)))
+
+			userlib.DebugMsg("Overwriting without version history removes every old chunk.")
+			err = alice.SetVersionLimit(aliceFile, 0)
+			Expect(err).To(BeNil())
+			before := len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, content[:15000])
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before - 2*12))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content[:15000]))
+		})
+
+		Specify("Empty files still get a single content node", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(1))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(BeEmpty())
+
+			client.ChunkSize = 0
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Truncate and WriteAt Tests", func() {
+
+		var defaultChunkSize int
+		var content []byte
+
+		BeforeEach(func() {
+			defaultChunkSize = client.ChunkSize
+			client.ChunkSize = 100
+			content = make([]byte, 30000)
+			for i := range content {
+				content[i] = byte(i % 251)
+			}
+		})
+
+		AfterEach(func() {
+			client.ChunkSize = defaultChunkSize
+		})
+
+		Specify("WriteAt overwrites a range in place and can extend the file", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob overwrites 250 bytes spanning several nodes.")
+			edit := []byte(strings.Repeat("x", 250))
+			userlib.DatastoreResetBandwidth()
+			err = bob.WriteAt(bobFile, 15050, edit)
+			Expect(err).To(BeNil())
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", len(content)/2))
+			copy(content[15050:], edit)
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(300))
+			Expect(info.LastWriter).To(Equal("bob"))
+
+			userlib.DebugMsg("Writing over the end grows the file.")
+			err = alice.WriteAt(aliceFile, 29950, edit)
+			Expect(err).To(BeNil())
+			content = append(content[:29950], edit...)
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			data, err = bob.ReadAt(bobFile, 30050, 200)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content[30050:30200]))
+
+			err = alice.WriteAt(aliceFile, len(content), []byte(contentOne))
+			Expect(err).To(BeNil())
+			content = append(content, []byte(contentOne)...)
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+
+			userlib.DebugMsg("Writes starting past the end or before the start fail.")
+			err = alice.WriteAt(aliceFile, len(content)+1, edit)
+			Expect(err).ToNot(BeNil())
+			err = alice.WriteAt(aliceFile, -1, edit)
+			Expect(err).ToNot(BeNil())
+			err = alice.WriteAt(aliceFile+"missing", 0, edit)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Truncate shrinks, grows and empties a file", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Shrinking across index pages frees the dropped nodes.")
+			before := len(userlib.DatastoreGetMap())
+			err = alice.Truncate(aliceFile, 13050)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before - 2*169 - 1))
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.Size).To(Equal(13050))
+			Expect(info.NumNodes).To(Equal(131))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content[:13050]))
+
+			userlib.DebugMsg("Appends and reads carry on from the new end.")
+			err = alice.AppendToFile(aliceFile, content[:300])
+			Expect(err).To(BeNil())
+			expected := append(append([]byte{}, content[:13050]...), content[:300]...)
+			data, err = alice.ReadAt(aliceFile, 12990, 200)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected[12990:13190]))
+			info, err = alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(134))
+
+			userlib.DebugMsg("Truncating to a node boundary and growing with zeros.")
+			err = alice.Truncate(aliceFile, 13000)
+			Expect(err).To(BeNil())
+			info, err = alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(130))
+			err = alice.Truncate(aliceFile, 13150)
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(append(append([]byte{}, content[:13000]...), make([]byte, 150)...)))
+
+			userlib.DebugMsg("Truncating to zero leaves a single empty node.")
+			err = alice.Truncate(aliceFile, 0)
+			Expect(err).To(BeNil())
+			info, err = alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(1))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(BeEmpty())
+
+			err = alice.Truncate(aliceFile, -1)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("CopyFile Tests", func() {
+
+		var defaultChunkSize int
+		var defaultMaxVersions int
+		var content []byte
+
+		BeforeEach(func() {
+			defaultChunkSize = client.ChunkSize
+			defaultMaxVersions = client.DefaultMaxVersions
+			client.ChunkSize = 10000
+			content = make([]byte, 200000)
+			for i := range content {
+				content[i] = byte(i % 241)
+			}
+		})
+
+		AfterEach(func() {
+			client.ChunkSize = defaultChunkSize
+			client.DefaultMaxVersions = defaultMaxVersions
+		})
+
+		Specify("Copies share chunks but edits to either never affect the other", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Copying doesn't re-upload the contents.")
+			userlib.DatastoreResetBandwidth()
+			err = alice.CopyFile(aliceFile, "copy.txt")
+			Expect(err).To(BeNil())
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", len(content)/4))
+			data, err := alice.LoadFile("copy.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			info, err := alice.Stat("copy.txt")
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(20))
+			Expect(info.Owner).To(Equal("alice"))
+
+			userlib.DebugMsg("Edits through the original don't reach the copy.")
+			original := append([]byte{}, content...)
+			err = bob.WriteAt(bobFile, 500, []byte(strings.Repeat("b", 1000)))
+			Expect(err).To(BeNil())
+			err = bob.Truncate(bobFile, 5500)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile("copy.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(original))
+
+			userlib.DebugMsg("Edits to the copy don't reach the original.")
+			expected, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			err = alice.WriteAt("copy.txt", 0, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			copy(original, []byte(contentTwo))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			data, err = alice.ReadAt("copy.txt", 0, 1200)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(original[:1200]))
+
+			userlib.DebugMsg("Revoking the original leaves the copy readable.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile("copy.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(original))
+
+			err = alice.CopyFile(aliceFile, "copy.txt")
+			Expect(err).ToNot(BeNil())
+			err = alice.CopyFile("missing.txt", "other.txt")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Shared chunks are deleted once no copy uses them", func() {
+			client.DefaultMaxVersions = 0
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+
+			err = alice.CopyFile(aliceFile, "copy.txt")
+			Expect(err).To(BeNil())
+			err = alice.CopyFile("copy.txt", "copy2.txt")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("60 nodes share 20 chunks, each with a reference count.")
+			before := len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("copy.txt", []byte{})
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before - 2*20 + 2*2))
+			data, err := alice.LoadFile("copy2.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+
+			userlib.DebugMsg("Emptying the last copy frees the chunks and their counts.")
+			err = alice.StoreFile("copy2.txt", []byte{})
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before - 5*20 + 3*2))
+		})
+
+	})
+
+	Describe("Version Tests", func() {
+
+		Specify("StoreFile keeps old content as versions everyone with access can restore", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			for _, name := range []string{"bob", "charles"} {
+				invite, err := alice.CreateInvitation(aliceFile, name)
+				Expect(err).To(BeNil())
+				if name == "bob" {
+					err = bob.AcceptInvitation("alice", invite, bobFile)
+				} else {
+					err = charles.AcceptInvitation("alice", invite, charlesFile)
+				}
+				Expect(err).To(BeNil())
+			}
+
+			userlib.DebugMsg("Bob overwrites the file twice.")
+			err = bob.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			versions, err := charles.ListVersions(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(len(versions)).To(Equal(2))
+			Expect(versions[0].Version).To(Equal(1))
+			Expect(versions[0].Size).To(Equal(len(contentOne + contentTwo)))
+			Expect(versions[0].LastWriter).To(Equal("alice"))
+			Expect(versions[1].Version).To(Equal(2))
+			Expect(versions[1].LastWriter).To(Equal("bob"))
+			data, err := charles.LoadVersion(charlesFile, 1)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Restoring keeps the overwritten content as a version too.")
+			err = alice.RestoreVersion(aliceFile, 1)
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadVersion(aliceFile, 1)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			data, err = alice.LoadVersion(aliceFile, 3)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("History survives revoking Bob, who loses access to it.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			versions, err = charles.ListVersions(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(len(versions)).To(Equal(3))
+			data, err = charles.LoadVersion(charlesFile, 2)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			_, err = bob.ListVersions(bobFile)
+			Expect(err).ToNot(BeNil())
+			_, err = bob.LoadVersion(bobFile, 2)
+			Expect(err).ToNot(BeNil())
+
+			_, err = charles.LoadVersion(charlesFile, 4)
+			Expect(err).ToNot(BeNil())
+			err = charles.RestoreVersion(charlesFile, 7)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Versions past the file's limit are deleted", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Replacing an empty file keeps it as a version too.")
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(versions)).To(Equal(1))
+			data, err := alice.LoadVersion(aliceFile, versions[0].Version)
+			Expect(err).To(BeNil())
+			Expect(data).To(BeEmpty())
+
+			err = alice.SetVersionLimit(aliceFile, 3)
+			Expect(err).To(BeNil())
+			for i := 0; i < 5; i++ {
+				err = alice.StoreFile(aliceFile, []byte(strings.Repeat(contentTwo, i+2)))
+				Expect(err).To(BeNil())
+			}
+			versions, err = alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(versions)).To(Equal(3))
+			Expect(versions[0].Version).To(Equal(4))
+			Expect(versions[2].Version).To(Equal(6))
+			_, err = alice.LoadVersion(aliceFile, 1)
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Lowering the limit frees the dropped versions.")
+			before := len(userlib.DatastoreGetMap())
+			err = alice.SetVersionLimit(aliceFile, 1)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before - 2*(1+2+1)))
+			data, err = alice.LoadVersion(aliceFile, 6)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(strings.Repeat(contentTwo, 5))))
+
+			err = alice.SetVersionLimit(aliceFile, -1)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Trash Tests", func() {
+
+		var defaultRetention time.Duration
+
+		BeforeEach(func() {
+			defaultRetention = client.TrashRetention
+		})
+
+		AfterEach(func() {
+			client.TrashRetention = defaultRetention
+		})
+
+		Specify("Deleted files can be restored with their sharing intact", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("docs/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation("docs/"+aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice deletes her file, Bob keeps access.")
+			err = alice.DeleteFile("docs/" + aliceFile)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile("docs/" + aliceFile)
+			Expect(err).ToNot(BeNil())
+			entries, err := alice.ReadDir("docs")
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+			trash, err := alice.ListTrash()
+			Expect(err).To(BeNil())
+			Expect(len(trash)).To(Equal(1))
+			Expect(trash[0].Name).To(Equal("docs/" + aliceFile))
+			Expect(trash[0].Key).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("A new file can take the name, but then restoring it fails.")
+			err = alice.StoreFile("docs/"+aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = alice.RestoreFromTrash(trash[0].Id)
+			Expect(err).ToNot(BeNil())
+			err = alice.DeleteFile("docs/" + aliceFile)
+			Expect(err).To(BeNil())
+			err = alice.RestoreFromTrash(trash[0].Id)
+			Expect(err).To(BeNil())
+
+			data, err := alice.LoadFile("docs/" + aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			trash, err = alice.ListTrash()
+			Expect(err).To(BeNil())
+			Expect(len(trash)).To(Equal(1))
+
+			userlib.DebugMsg("Alice can still revoke Bob from the restored file.")
+			err = alice.RevokeAccess("docs/"+aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+
+			err = alice.RestoreFromTrash(uuid.New())
+			Expect(err).ToNot(BeNil())
+			err = alice.DeleteFile("docs")
+			Expect(err).ToNot(BeNil())
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("A trashed recipient's node keeps getting new keys on revocation", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, aliceFile)
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("bob", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob deletes his copy, then Alice revokes Doris.")
+			err = bob.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "doris")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			trash, err := bob.ListTrash()
+			Expect(err).To(BeNil())
+			err = bob.RestoreFromTrash(trash[0].Id)
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Purging only drops Bob's records, Charles keeps access.")
+			err = bob.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			err = bob.EmptyTrash()
+			Expect(err).To(BeNil())
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = charles.LoadFile(charlesFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Files deleted from a shared folder leave it for every member", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("team")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("team/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation("team", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "shared")
+			Expect(err).To(BeNil())
+
+			err = bob.DeleteFile("shared/" + aliceFile)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile("team/" + aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.DeleteFile("shared")
+			Expect(err).ToNot(BeNil())
+
+			trash, err := bob.ListTrash()
+			Expect(err).To(BeNil())
+			Expect(trash[0].Key).To(BeNil())
+			err = bob.RestoreFromTrash(trash[0].Id)
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile("team/" + aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Emptying the trash deletes the file's data.")
+			before := len(userlib.DatastoreGetMap())
+			err = alice.DeleteFile("team/" + aliceFile)
+			Expect(err).To(BeNil())
+			err = alice.EmptyTrash()
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before - 5 + 1))
+		})
+
+		Specify("Trashed files are purged after the retention period", func() {
+			client.TrashRetention = 50 * time.Millisecond
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			before := len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+			trash, err := alice.ListTrash()
+			Expect(err).To(BeNil())
+			Expect(len(trash)).To(Equal(1))
+
+			time.Sleep(100 * time.Millisecond)
+			trash, err = alice.ListTrash()
+			Expect(err).To(BeNil())
+			Expect(trash).To(BeEmpty())
+
+			// Only the root listing, trash, search index and usage record are left
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before + 4))
+		})
+
+		Specify("Expired files are purged by the next lookup, not just by the trash calls", func() {
+			client.TrashRetention = 50 * time.Millisecond
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+
+			time.Sleep(100 * time.Millisecond)
+			data, err := alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			charged, err := client.ChargedUsage(alice)
+			Expect(err).To(BeNil())
+			Expect(charged).To(Equal(client.Usage{Bytes: len(contentTwo), Objects: 1}))
+			after := len(userlib.DatastoreGetMap())
+			trash, err := alice.ListTrash()
+			Expect(err).To(BeNil())
+			Expect(trash).To(BeEmpty())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(after))
+		})
+
+		Specify("Invitations to a trashed file can still be accepted", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Once it's restored, Alice and Bob share it as usual.")
+			trash, err := alice.ListTrash()
+			Expect(err).To(BeNil())
+			err = alice.RestoreFromTrash(trash[0].Id)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Compression Tests", func() {
+
+		var defaultChunkSize int
+		var logs []byte
+		var counts []byte
+
+		// Size of the largest entry added since before was taken
+		largestNewEntry := func(before map[uuid.UUID]bool) (largest int) {
+			for key, value := range userlib.DatastoreGetMap() {
+				if !before[key] && len(value) > largest {
+					largest = len(value)
+				}
+			}
+			return largest
+		}
+
+		entrySet := func() map[uuid.UUID]bool {
+			keys := map[uuid.UUID]bool{}
+			for key := range userlib.DatastoreGetMap() {
+				keys[key] = true
+			}
+			return keys
+		}
+
+		BeforeEach(func() {
+			defaultChunkSize = client.ChunkSize
+			client.ChunkSize = 128 * 1024
+			logs = []byte(strings.Repeat("2024-01-01,alice,42\n", 5000))
+			counts = []byte{}
+			for i := 0; len(counts) < len(logs); i++ {
+				counts = append(counts, []byte("2024-01-01,bob,"+strconv.Itoa(i%10)+"\n")...)
+			}
+			counts = counts[:len(logs)]
+		})
+
+		AfterEach(func() {
+			client.ChunkSize = defaultChunkSize
+		})
+
+		Specify("Compressed files load transparently for every sharer", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Compressed chunks take a fraction of the space.")
+			before := datastoreBytes()
+			err = alice.StoreFile("raw.csv", logs)
+			Expect(err).To(BeNil())
+			rawBytes := datastoreBytes() - before
+
+			err = alice.StoreFile(aliceFile, []byte{})
+			Expect(err).To(BeNil())
+			err = alice.SetCompression(aliceFile, client.CompressDeflate, false)
+			Expect(err).To(BeNil())
+			before = datastoreBytes()
+			err = alice.StoreFile(aliceFile, logs)
+			Expect(err).To(BeNil())
+			Expect(datastoreBytes() - before).To(BeNumerically("<", rawBytes/10))
+
+			userlib.DebugMsg("Bob reads and edits it without knowing it's compressed.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(logs))
+			data, err = bob.ReadAt(bobFile, 50005, 40)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(logs[50005:50045]))
+			err = bob.WriteAt(bobFile, 20, []byte("2024-01-02"))
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected := append(append([]byte{}, logs...), []byte(contentOne)...)
+			copy(expected[20:], []byte("2024-01-02"))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+
+			userlib.DebugMsg("Compacting recompresses chunks written before compression was on.")
+			err = alice.SetCompression("raw.csv", client.CompressDeflate, true)
+			Expect(err).To(BeNil())
+			err = alice.CompactFile("raw.csv")
+			Expect(err).To(BeNil())
+			err = alice.CompactFile("raw.csv")
+			Expect(err).To(BeNil())
+			Expect(datastoreBytes() - before).To(BeNumerically("<", rawBytes/5))
+			data, err = alice.LoadFile("raw.csv")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(logs))
+
+			err = alice.SetCompression(aliceFile, "zip", false)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Padding hides how well each chunk compressed", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			sizes := map[bool][]int{}
+			for _, pad := range []bool{false, true} {
+				for _, content := range [][]byte{logs, counts} {
+					err = alice.StoreFile(aliceFile, []byte{})
+					Expect(err).To(BeNil())
+					err = alice.SetVersionLimit(aliceFile, 0)
+					Expect(err).To(BeNil())
+					err = alice.SetCompression(aliceFile, client.CompressDeflate, pad)
+					Expect(err).To(BeNil())
+					before := entrySet()
+					err = alice.StoreFile(aliceFile, content)
+					Expect(err).To(BeNil())
+					sizes[pad] = append(sizes[pad], largestNewEntry(before))
+				}
+			}
+			Expect(sizes[false][0]).ToNot(Equal(sizes[false][1]))
+			Expect(sizes[true][0]).To(Equal(sizes[true][1]))
+		})
+
+	})
+
+	Describe("Deduplication Tests", func() {
+
+		var defaultChunkSize int
+		var defaultMaxVersions int
+		var content []byte
+
+		BeforeEach(func() {
+			defaultChunkSize = client.ChunkSize
+			defaultMaxVersions = client.DefaultMaxVersions
+			client.ChunkSize = 16 * 1024
+			client.DefaultDedup = true
+			content = userlib.RandomBytes(300000)
+		})
+
+		AfterEach(func() {
+			client.ChunkSize = defaultChunkSize
+			client.DefaultMaxVersions = defaultMaxVersions
+			client.DefaultDedup = false
+		})
+
+		Specify("Repeated and edited content in the owner's files is stored once", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			before := datastoreBytes()
+			err = alice.StoreFile("export.bin", content)
+			Expect(err).To(BeNil())
+			fullBytes := datastoreBytes() - before
+			Expect(fullBytes).To(BeNumerically(">", len(content)))
+			info, err := alice.Stat("export.bin")
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(BeNumerically(">", len(content)/client.ChunkSize))
+
+			userlib.DebugMsg("Appending the same content only adds its nodes.")
+			before = datastoreBytes()
+			err = alice.AppendToFile("export.bin", content)
+			Expect(err).To(BeNil())
+			Expect(datastoreBytes() - before).To(BeNumerically("<", fullBytes/10))
+			doubled := append(append([]byte{}, content...), content...)
+
+			userlib.DebugMsg("Inserting bytes in the middle only changes the chunks around them.")
+			edited := append(append(append([]byte{}, content[:150000]...), []byte(contentOne)...), content[150000:]...)
+			before = datastoreBytes()
+			err = alice.StoreFile("export.bin", edited)
+			Expect(err).To(BeNil())
+			Expect(datastoreBytes() - before).To(BeNumerically("<", fullBytes/4))
+			data, err := alice.LoadFile("export.bin")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(edited))
+
+			userlib.DebugMsg("Another of alice's files with the same content only adds nodes and reference counts.")
+			before = datastoreBytes()
+			entries := len(userlib.DatastoreGetMap())
+			err = alice.StoreFile("other.bin", content)
+			Expect(err).To(BeNil())
+			Expect(datastoreBytes() - before).To(BeNumerically("<", fullBytes/10))
+			Expect(len(userlib.DatastoreGetMap()) - entries).To(BeNumerically(">=", info.NumNodes))
+			Expect(len(userlib.DatastoreGetMap()) - entries).To(BeNumerically("<", 2*info.NumNodes+15))
+
+			userlib.DebugMsg("Bob's convergent key is his own, so his copy shares nothing with alice's.")
+			before = datastoreBytes()
+			err = bob.StoreFile("copy.bin", content)
+			Expect(err).To(BeNil())
+			Expect(datastoreBytes() - before).To(BeNumerically(">", len(content)))
+
+			userlib.DebugMsg("Recipients read and edit a deduplicated file as usual.")
+			invite, err := alice.CreateInvitation("export.bin", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "export.bin")
+			Expect(err).To(BeNil())
+			err = bob.WriteAt("export.bin", 1000, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			copy(edited[1000:], []byte(contentTwo))
+			data, err = alice.LoadFile("export.bin")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(edited))
+			data, err = alice.LoadVersion("export.bin", 1)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(doubled))
+			data, err = alice.LoadFile("other.bin")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+			data, err = bob.LoadFile("copy.bin")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(content))
+		})
+
+		Specify("Chunks are deleted when the last node using them is overwritten", func() {
+			client.DefaultMaxVersions = 0
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			before := len(userlib.DatastoreGetMap())
+			err = alice.StoreFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			chunks := info.NumNodes
+			afterOne := len(userlib.DatastoreGetMap())
+
+			userlib.DebugMsg("Repeating the content adds a node and a reference count per chunk.")
+			err = alice.AppendToFile(aliceFile, content)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap()) - afterOne).To(BeNumerically(">=", 2*chunks))
+			Expect(len(userlib.DatastoreGetMap()) - afterOne).To(BeNumerically("<", 2*chunks+5))
+
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap()) - before).To(BeNumerically("<", 20))
+		})
+
+	})
+
+	Describe("Compaction Tests", func() {
+
+		var defaultChunkSize int
+
+		BeforeEach(func() {
+			defaultChunkSize = client.ChunkSize
+			client.ChunkSize = 1000
+		})
+
+		AfterEach(func() {
+			client.ChunkSize = defaultChunkSize
+			client.CompactThreshold = 0
+		})
+
+		Specify("CompactFile merges appends without disturbing readers or recipients", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Building a file from 300 small appends.")
+			expected := []byte{}
+			err = alice.StoreFile(aliceFile, expected)
+			Expect(err).To(BeNil())
+			for i := 0; i < 300; i++ {
+				piece := []byte("entry " + strconv.Itoa(1000+i) + ";")
+				err = alice.AppendToFile(aliceFile, piece)
+				Expect(err).To(BeNil())
+				expected = append(expected, piece...)
+			}
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(301))
+
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("A reader opened before compaction reads the old chain to the end.")
+			reader, err := alice.OpenReader(aliceFile)
+			Expect(err).To(BeNil())
+			head := make([]byte, 100)
+			_, err = io.ReadFull(reader, head)
+			Expect(err).To(BeNil())
+
+			err = alice.CompactFile(aliceFile)
+			Expect(err).To(BeNil())
+			info, err = bob.Stat(bobFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(4))
+			Expect(info.Size).To(Equal(len(expected)))
+
+			rest, err := io.ReadAll(reader)
+			Expect(err).To(BeNil())
+			Expect(append(head, rest...)).To(Equal(expected))
+			Expect(reader.Close()).To(BeNil())
+
+			userlib.DebugMsg("Recipients see the same content through the compacted chain.")
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+			data, err = bob.ReadAt(bobFile, 995, 10)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected[995:1005]))
+			err = bob.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected = append(expected, []byte(contentOne)...)
+
+			userlib.DebugMsg("The next compaction deletes the retired chain.")
+			before := len(userlib.DatastoreGetMap())
+			err = alice.CompactFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(Equal(before - (2*301 + 3) + (2*4 + 1)))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+
+			err = alice.CompactFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("AppendToFile compacts automatically past the threshold", func() {
+			client.CompactThreshold = 50
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			expected := []byte(contentOne)
+			err = alice.StoreFile(aliceFile, expected)
+			Expect(err).To(BeNil())
+			for i := 0; i < 120; i++ {
+				err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+				Expect(err).To(BeNil())
+				expected = append(expected, []byte(contentTwo)...)
+
+				info, err := alice.Stat(aliceFile)
+				Expect(err).To(BeNil())
+				Expect(info.NumNodes).To(BeNumerically("<=", 50))
+			}
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+		})
+
+		Specify("A threshold below what compaction leaves doesn't rewrite every append", func() {
+			client.CompactThreshold = 2
+			client.ChunkSize = 4000
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			expected := make([]byte, 5*client.ChunkSize)
+			err = alice.StoreFile(aliceFile, expected)
+			Expect(err).To(BeNil())
+			for i := 0; i < 6; i++ {
+				userlib.DatastoreResetBandwidth()
+				err = alice.AppendToFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", len(expected)))
+				expected = append(expected, []byte(contentOne)...)
+			}
+
+			userlib.DebugMsg("Once the chain is twice as long as it needs to be, it's compacted.")
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			expected = append(expected, []byte(contentOne)...)
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.NumNodes).To(Equal(6))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(expected))
+		})
+
+		Specify("Bad settings are rejected instead of panicking", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			writer, err := alice.AppendWriter(aliceFile)
+			Expect(err).To(BeNil())
+
+			client.ChunkSize = 0
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			_, err = writer.Write([]byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			client.ChunkSize = 1000
+			client.CompactThreshold = -1
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+	})
+
+	Describe("Attribute Tests", func() {
+
+		Specify("Attributes are shared with recipients and kept across overwrites", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			attrs, err := alice.ListAttrs(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(attrs).To(BeEmpty())
+			_, err = alice.GetAttr(aliceFile, client.AttrContentType)
+			Expect(err).ToNot(BeNil())
+
+			err = alice.SetAttr(aliceFile, client.AttrContentType, "text/csv")
+			Expect(err).To(BeNil())
+			err = alice.SetAttr(aliceFile, client.AttrLabels, "finance,q3")
+			Expect(err).To(BeNil())
+			err = alice.SetAttr(aliceFile, "", "value")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Bob reads and changes Alice's attributes.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			value, err := bob.GetAttr(bobFile, client.AttrContentType)
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal("text/csv"))
+			err = bob.SetAttr(bobFile, "reviewed-by", "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Overwriting and appending keep attributes, and an empty value removes one.")
+			err = bob.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = alice.SetAttr(aliceFile, client.AttrLabels, "")
+			Expect(err).To(BeNil())
+			attrs, err = bob.ListAttrs(bobFile)
+			Expect(err).To(BeNil())
+			Expect(attrs).To(Equal(map[string]string{
+				client.AttrContentType: "text/csv",
+				"reviewed-by":          "bob",
+			}))
+
+			userlib.DebugMsg("Copies start with the same attributes but change independently.")
+			err = alice.CopyFile(aliceFile, "copy.csv")
+			Expect(err).To(BeNil())
+			err = alice.SetAttr("copy.csv", "reviewed-by", "alice")
+			Expect(err).To(BeNil())
+			value, err = alice.GetAttr(aliceFile, "reviewed-by")
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal("bob"))
+
+			userlib.DebugMsg("Bob loses access to the attributes when revoked.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.ListAttrs(bobFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.SetAttr(bobFile, client.AttrContentType, "text/plain")
+			Expect(err).ToNot(BeNil())
+			value, err = alice.GetAttr(aliceFile, client.AttrContentType)
+			Expect(err).To(BeNil())
+			Expect(value).To(Equal("text/csv"))
+		})
+
+	})
+
+	Describe("Search Tests", func() {
+
+		Specify("Search finds files by prefix, substring and label from any session", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("reports")
+			Expect(err).To(BeNil())
+			for _, name := range []string{"reports/2023-q4.csv", "reports/2024-q1.csv", "notes.txt"} {
+				err = alice.StoreFile(name, []byte(contentOne))
+				Expect(err).To(BeNil())
+			}
+			err = alice.SetAttr("reports/2024-q1.csv", client.AttrLabels, "finance, draft")
+			Expect(err).To(BeNil())
+			err = alice.SetAttr("notes.txt", client.AttrLabels, "draft")
+			Expect(err).To(BeNil())
+
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			names, err := aliceLaptop.Search(client.SearchPrefix, "reports/")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"reports/2023-q4.csv", "reports/2024-q1.csv"}))
+			names, err = aliceLaptop.Search(client.SearchSubstring, "q1")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"reports/2024-q1.csv"}))
+			names, err = aliceLaptop.Search(client.SearchTag, "draft")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"notes.txt", "reports/2024-q1.csv"}))
+			_, err = aliceLaptop.Search("regex", "q.")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Deleting, restoring and copying keep the index up to date.")
+			err = alice.DeleteFile("notes.txt")
+			Expect(err).To(BeNil())
+			names, err = alice.Search(client.SearchTag, "draft")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"reports/2024-q1.csv"}))
+			trash, err := alice.ListTrash()
+			Expect(err).To(BeNil())
+			err = alice.RestoreFromTrash(trash[0].Id)
+			Expect(err).To(BeNil())
+			err = alice.CopyFile("notes.txt", "notes-copy.txt")
+			Expect(err).To(BeNil())
+			names, err = alice.Search(client.SearchTag, "draft")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"notes-copy.txt", "notes.txt", "reports/2024-q1.csv"}))
+
+			userlib.DebugMsg("Accepted files and shared folders are indexed under the recipient's names.")
+			invite, err := alice.CreateInvitation("reports/2024-q1.csv", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "q1.csv")
+			Expect(err).To(BeNil())
+			err = alice.Mkdir("team")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("team/plan.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation("team", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "shared")
+			Expect(err).To(BeNil())
+			names, err = bob.Search(client.SearchSubstring, "")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"q1.csv", "shared/plan.txt"}))
+			names, err = bob.Search(client.SearchTag, "finance")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"q1.csv"}))
+
+			userlib.DebugMsg("Changes made by other users show up after rebuilding the index.")
+			err = alice.StoreFile("team/budget.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = alice.SetAttr("team/budget.txt", client.AttrLabels, "finance")
+			Expect(err).To(BeNil())
+			err = bob.RebuildIndex()
+			Expect(err).To(BeNil())
+			names, err = bob.Search(client.SearchTag, "finance")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"q1.csv", "shared/budget.txt"}))
+
+			userlib.DebugMsg("Folders the user was revoked from are left out, and rebuilding still works.")
+			err = alice.RevokeAccess("team", "bob")
+			Expect(err).To(BeNil())
+			err = bob.RebuildIndex()
+			Expect(err).To(BeNil())
+			names, err = bob.Search(client.SearchTag, "finance")
+			Expect(err).To(BeNil())
+			Expect(names).To(Equal([]string{"q1.csv"}))
+		})
+
+		Specify("The datastore never sees filenames or labels in the clear", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("quarterly-secret.csv", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.SetAttr("quarterly-secret.csv", client.AttrLabels, "confidential")
+			Expect(err).To(BeNil())
+			for _, value := range userlib.DatastoreGetMap() {
+				Expect(string(value)).ToNot(ContainSubstring("quarterly"))
+				Expect(string(value)).ToNot(ContainSubstring("confidential"))
+			}
+		})
+
+	})
+
+	Describe("Usage Tests", func() {
+
+		AfterEach(func() {
+			client.StorageQuota = 0
+			client.ObjectQuota = 0
+		})
+
+		Specify("Owners are charged for every write to their files", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			usage, err := alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(client.Usage{Bytes: len(contentOne), Objects: 1}))
+
+			userlib.DebugMsg("Bob's append is charged to Alice.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(client.Usage{Bytes: len(contentOne + contentTwo), Objects: 2}))
+			usage, err = bob.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(client.Usage{}))
+
+			userlib.DebugMsg("Versions count until they're pruned.")
+			err = bob.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(client.Usage{Bytes: len(contentOne + contentTwo + contentThree), Objects: 3}))
+			err = alice.SetVersionLimit(aliceFile, 0)
+			Expect(err).To(BeNil())
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(client.Usage{Bytes: len(contentThree), Objects: 1}))
+
+			userlib.DebugMsg("Files members create in a shared folder are charged to its owner.")
+			err = alice.Mkdir("team")
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation("team", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "shared")
+			Expect(err).To(BeNil())
+			err = bob.Mkdir("shared/notes")
+			Expect(err).To(BeNil())
+			err = bob.StoreFile("shared/notes/todo.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(client.Usage{Bytes: len(contentThree + contentTwo), Objects: 2}))
+
+			userlib.DebugMsg("Trashed files count until they're purged.")
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage.Bytes).To(Equal(len(contentThree + contentTwo)))
+			err = alice.EmptyTrash()
+			Expect(err).To(BeNil())
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(client.Usage{Bytes: len(contentTwo), Objects: 1}))
+		})
+
+		Specify("Only the owner can change their usage record", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Recounting only rewrites the usage record.")
+			before := make(map[userlib.UUID][]byte)
+			for id, value := range userlib.DatastoreGetMap() {
+				before[id] = value
+			}
+			_, err = alice.Usage()
+			Expect(err).To(BeNil())
+			var usageId userlib.UUID
+			changed := 0
+			for id, value := range userlib.DatastoreGetMap() {
+				if string(before[id]) != string(value) {
+					usageId = id
+					changed++
+				}
+			}
+			Expect(changed).To(Equal(1))
+
+			userlib.DebugMsg("A forged record is rejected by quota checks and replaced by the owner's recount.")
+			forged, _ := userlib.DatastoreGet(usageId)
+			forged = append([]byte{}, forged...)
+			forged[len(forged)-1] ^= 1
+			userlib.DatastoreSet(usageId, forged)
+			client.StorageQuota = 1000
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			usage, err := alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(client.Usage{Bytes: len(contentOne), Objects: 1}))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Writes past the owner's quota fail without changing the file", func() {
+			client.StorageQuota = 100
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, make([]byte, 60))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, make([]byte, 50))
+			Expect(err).To(Equal(client.ErrQuotaExceeded))
+			err = alice.StoreFile("other.txt", make([]byte, 50))
+			Expect(err).To(Equal(client.ErrQuotaExceeded))
+			_, err = alice.LoadFile("other.txt")
+			Expect(err).ToNot(BeNil())
+			entries, err := alice.ReadDir("")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			names, err := alice.Search(client.SearchPrefix, "other")
+			Expect(err).To(BeNil())
+			Expect(names).To(BeEmpty())
+			err = alice.StoreFile("other.txt", make([]byte, 10))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob's writes to Alice's file count against Alice's quota, not his.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, make([]byte, 50))
+			Expect(err).To(Equal(client.ErrQuotaExceeded))
+			err = bob.StoreFile("own.txt", make([]byte, 90))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal(make([]byte, 60)))
+
+			userlib.DebugMsg("Freeing space makes room again.")
+			err = alice.SetVersionLimit(aliceFile, 0)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, make([]byte, 10))
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, make([]byte, 50))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Content node counts have their own quota.")
+			client.ObjectQuota = 2
+			err = alice.AppendToFile(aliceFile, []byte(contentOne))
+			Expect(err).To(Equal(client.ErrQuotaExceeded))
+		})
+
+		Specify("Quota checks read the charged record, others' writes count once the owner recounts", func() {
+			client.StorageQuota = 100
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, make([]byte, 40))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, make([]byte, 40))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice's writes are checked without recounting.")
+			err = alice.StoreFile("other.txt", make([]byte, 50))
+			Expect(err).To(BeNil())
+			charged, err := client.ChargedUsage(alice)
+			Expect(err).To(BeNil())
+			Expect(charged.Bytes).To(Equal(90))
+
+			userlib.DebugMsg("Once she recounts, Bob's append is charged and the quota is full.")
+			usage, err := alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage.Bytes).To(Equal(130))
+			err = alice.AppendToFile("other.txt", []byte{0})
+			Expect(err).To(Equal(client.ErrQuotaExceeded))
+		})
+
+		Specify("The chain compaction retires is charged until it's deleted", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.CompactFile(aliceFile)
+			Expect(err).To(BeNil())
+			charged, err := client.ChargedUsage(alice)
+			Expect(err).To(BeNil())
+			Expect(charged).To(Equal(client.Usage{Bytes: 2 * len(contentOne+contentTwo), Objects: 3}))
+			usage, err := alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(charged))
+
+			userlib.DebugMsg("Compacting again deletes the retired chain and credits it.")
+			err = alice.CompactFile(aliceFile)
+			Expect(err).To(BeNil())
+			charged, err = client.ChargedUsage(alice)
+			Expect(err).To(BeNil())
+			Expect(charged).To(Equal(client.Usage{Bytes: 2 * len(contentOne+contentTwo), Objects: 2}))
+
+			userlib.DebugMsg("So does the re-keying a revocation does.")
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			charged, err = client.ChargedUsage(alice)
+			Expect(err).To(BeNil())
+			Expect(charged).To(Equal(client.Usage{Bytes: len(contentOne + contentTwo), Objects: 1}))
+			usage, err = alice.Usage()
+			Expect(err).To(BeNil())
+			Expect(usage).To(Equal(charged))
+		})
+
+	})
+
+	Describe("Batch Tests", func() {
+
+		Specify("Other sessions see every file in a batch change at once", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile("data.csv", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("index.json", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation("data.csv", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			batch := alice.Begin()
+			err = batch.Append("data.csv", []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = batch.Append("data.csv", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = batch.Store("index.json", []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = batch.Append("index.json", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Store("new.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Nothing staged is visible before the batch commits.")
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = aliceLaptop.ReadAt("data.csv", 0, len(contentOne))
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = aliceLaptop.LoadFile("index.json")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			_, err = aliceLaptop.LoadFile("new.txt")
+			Expect(err).ToNot(BeNil())
+
+			err = batch.Commit()
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentThree + contentOne)))
+			data, err = aliceLaptop.ReadAt("data.csv", len(contentOne), len(contentThree))
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+			data, err = aliceLaptop.LoadFile("index.json")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree + contentTwo)))
+			data, err = aliceLaptop.LoadVersion("index.json", 1)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			data, err = aliceLaptop.LoadFile("new.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("A committed batch can't be reused.")
+			err = batch.Commit()
+			Expect(err).ToNot(BeNil())
+			err = batch.Append("data.csv", []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Recipients can batch writes to shared files too.")
+			batch = bob.Begin()
+			err = batch.Append(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Commit()
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile("data.csv")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentThree + contentOne + contentTwo)))
+		})
+
+		Specify("New files are only listed once their batch commits", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("data.csv", []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("A batch that stops before committing leaves no trace of its new file.")
+			batch := alice.Begin()
+			err = batch.Append("data.csv", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Store("new.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = client.StopCommit(batch, false)
+			Expect(err).To(BeNil())
+			_, err = aliceLaptop.LoadFile("new.txt")
+			Expect(err).ToNot(BeNil())
+			entries, err := aliceLaptop.ReadDir("")
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			data, err := aliceLaptop.LoadFile("data.csv")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = aliceLaptop.StoreFile("new.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("One that stops right after committing has its new file listed by the next lookup.")
+			batch = alice.Begin()
+			err = batch.Append("data.csv", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Store("later.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = client.StopCommit(batch, true)
+			Expect(err).To(BeNil())
+			data, err = aliceLaptop.LoadFile("later.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = aliceLaptop.LoadFile("data.csv")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			data, err = alice.LoadFile("new.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+		})
+
+		Specify("Linked names in one batch stage the same file", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.Link(aliceFile, "alias.txt")
+			Expect(err).To(BeNil())
+
+			batch := alice.Begin()
+			err = batch.Append(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Append("alias.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = batch.Commit()
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile("alias.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+
+			batch = alice.Begin()
+			err = batch.Store("alias.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Append(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = batch.Commit()
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo + contentOne)))
+			versions, err := alice.ListVersions(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(1))
+			Expect(versions[0].Size).To(Equal(len(contentOne + contentTwo + contentThree)))
+		})
+
+		Specify("Committing leaves nothing behind that direct writes wouldn't", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			for _, user := range []*client.User{alice, bob} {
+				err = user.StoreFile(aliceFile, []byte(contentOne))
+				Expect(err).To(BeNil())
+				err = user.StoreFile(bobFile, []byte{})
+				Expect(err).To(BeNil())
+			}
+
+			before := len(userlib.DatastoreGetMap())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			direct := len(userlib.DatastoreGetMap()) - before
+
+			before = len(userlib.DatastoreGetMap())
+			batch := bob.Begin()
+			err = batch.Append(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Store(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = batch.Commit()
+			Expect(err).To(BeNil())
+			Expect(len(userlib.DatastoreGetMap()) - before).To(Equal(direct))
+		})
+
+		Specify("Aborting deletes everything the batch wrote", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID][]byte)
+			for id, value := range userlib.DatastoreGetMap() {
+				before[id] = value
+			}
+			batch := alice.Begin()
+			err = batch.Append(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Append(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = batch.Store(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = batch.Store(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = batch.Append("new.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = batch.Store("new.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Abort()
+			Expect(err).To(BeNil())
+			Expect(userlib.DatastoreGetMap()).To(Equal(before))
+
+			userlib.DebugMsg("An aborted batch can't be used again.")
+			err = batch.Commit()
+			Expect(err).ToNot(BeNil())
+			err = batch.Abort()
+			Expect(err).ToNot(BeNil())
+			_, err = alice.LoadFile("new.txt")
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Files changed or created after they were staged fail the commit", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			aliceLaptop, err = client.GetUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			batch := alice.Begin()
+			err = batch.Store(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = batch.Append(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			err = aliceLaptop.AppendToFile(bobFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			before := len(userlib.DatastoreGetMap())
+			err = batch.Commit()
+			Expect(err).ToNot(BeNil())
+			Expect(len(userlib.DatastoreGetMap())).To(BeNumerically("<", before))
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = alice.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo + contentOne)))
+
+			userlib.DebugMsg("A new file created by another session isn't overwritten.")
+			batch = alice.Begin()
+			err = batch.Store("new.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = aliceLaptop.StoreFile("new.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = batch.Commit()
+			Expect(err).ToNot(BeNil())
+			data, err = alice.LoadFile("new.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+		})
+
+	})
+
+	Describe("Link Tests", func() {
+
+		Specify("Linked names reach the same file and share and revoke it alike", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.Link(aliceFile, "docs/alias.txt")
+			Expect(err).To(BeNil())
+			err = alice.Link("docs/alias.txt", "second.txt")
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile("docs/alias.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile("second.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			entries, err := alice.ReadDir("docs")
+			Expect(err).To(BeNil())
+			Expect(entries).To(Equal([]client.DirEntry{{Name: "alias.txt"}}))
+
+			userlib.DebugMsg("Names that are taken, directories and shared folders can't be linked.")
+			err = alice.Link(aliceFile, "second.txt")
+			Expect(err).ToNot(BeNil())
+			err = alice.Link("docs", "docs-link")
+			Expect(err).ToNot(BeNil())
+			err = alice.Link("missing.txt", "other.txt")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Sharing through one name and revoking through another.")
+			invite, err := alice.CreateInvitation("docs/alias.txt", "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation("second.txt", "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			err = charles.AppendToFile(charlesFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile("docs/alias.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+
+		Specify("Deleting one name keeps the file under its others", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.Link(aliceFile, "b.txt")
+			Expect(err).To(BeNil())
+			err = alice.Link(aliceFile, "c.txt")
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Deleting the original name keeps the file and its sharing.")
+			err = alice.DeleteFile(aliceFile)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile("c.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+			info, err := alice.Stat("b.txt")
+			Expect(err).To(BeNil())
+			Expect(info.Owner).To(Equal("alice"))
+			trash, err := alice.ListTrash()
+			Expect(err).To(BeNil())
+			Expect(trash).To(BeEmpty())
+
+			userlib.DebugMsg("The file goes to the trash with its last name.")
+			err = alice.DeleteFile("c.txt")
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess("b.txt", "bob")
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			err = alice.DeleteFile("b.txt")
+			Expect(err).To(BeNil())
+			trash, err = alice.ListTrash()
+			Expect(err).To(BeNil())
+			Expect(len(trash)).To(Equal(1))
+			err = alice.RestoreFromTrash(trash[0].Id)
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile("b.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+		Specify("Invitations sent before the original name is deleted can still be accepted", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile("a.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.Link("a.txt", "b.txt")
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation("a.txt", "bob")
+			Expect(err).To(BeNil())
+			err = alice.DeleteFile("a.txt")
+			Expect(err).To(BeNil())
+
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = alice.AppendToFile("b.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+	})
+
+	Describe("Read-Only Share Tests", func() {
+
+		Specify("Readers can load a file but every write is refused", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("The first read-only invitation moves the file under a signed key.")
+			invite, err = alice.CreateInvitationWithAccess(aliceFile, "charles", client.AccessRead)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+
+			userlib.DebugMsg("Bob was already a writer and still is.")
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Charles can't change anything.")
+			err = charles.StoreFile(charlesFile, []byte(contentThree))
+			Expect(err).To(Equal(client.ErrReadOnly))
+			err = charles.AppendToFile(charlesFile, []byte(contentThree))
+			Expect(err).To(Equal(client.ErrReadOnly))
+			err = charles.WriteAt(charlesFile, 0, []byte(contentThree))
+			Expect(err).To(Equal(client.ErrReadOnly))
+			err = charles.Truncate(charlesFile, 0)
+			Expect(err).To(Equal(client.ErrReadOnly))
+			err = charles.SetAttr(charlesFile, client.AttrLabels, "mine")
+			Expect(err).To(Equal(client.ErrReadOnly))
+			err = charles.CompactFile(charlesFile)
+			Expect(err).To(Equal(client.ErrReadOnly))
+			err = charles.RevokeAccess(charlesFile, "bob")
+			Expect(err).To(Equal(client.ErrReadOnly))
+			batch := charles.Begin()
+			err = batch.Append(charlesFile, []byte(contentThree))
+			Expect(err).To(Equal(client.ErrReadOnly))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Readers can still copy the file into one of their own.")
+			err = charles.CopyFile(charlesFile, "copy.txt")
+			Expect(err).To(BeNil())
+			err = charles.AppendToFile("copy.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Changes to signed data are detected", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Flipping a byte in everything the append wrote.")
+			for key, value := range userlib.DatastoreGetMap() {
+				if old, ok := before[key]; ok && string(old) == string(value) {
+					continue
+				}
+				tampered := append([]byte{}, value...)
+				tampered[len(tampered)-1] ^= 1
+				userlib.DatastoreSet(key, tampered)
+			}
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Readers only pass on read access, and revocation keeps everyone's access", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Only the owner can start sharing a file read-only.")
+			_, err = bob.CreateInvitationWithAccess(bobFile, "charles", client.AccessRead)
+			Expect(err).ToNot(BeNil())
+			_, err = alice.CreateInvitationWithAccess(aliceFile, "charles", "admin")
+			Expect(err).ToNot(BeNil())
+
+			invite, err = alice.CreateInvitationWithAccess(aliceFile, "charles", client.AccessRead)
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			_, err = charles.CreateInvitation(charlesFile, "doris")
+			Expect(err).To(Equal(client.ErrReadOnly))
+			invite, err = charles.CreateInvitationWithAccess(charlesFile, "doris", client.AccessRead)
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("charles", invite, "dorisFile.txt")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Writers can still add other writers.")
+			invite, err = bob.CreateInvitationWithAccess(bobFile, "doris", client.AccessWrite)
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("bob", invite, "fromBob.txt")
+			Expect(err).To(BeNil())
+			err = doris.AppendToFile("fromBob.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = doris.AppendToFile("dorisFile.txt", []byte(contentTwo))
+			Expect(err).To(Equal(client.ErrReadOnly))
+
+			userlib.DebugMsg("Revoking bob's branch keeps charles reading and alice writing.")
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = doris.LoadFile("fromBob.txt")
+			Expect(err).ToNot(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err := doris.LoadFile("dorisFile.txt")
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			err = charles.StoreFile(charlesFile, []byte(contentThree))
+			Expect(err).To(Equal(client.ErrReadOnly))
+		})
+
+		Specify("Readers who rewrite the file's nodes still can't write or roll it back", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(aliceFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob makes his node look like the owner's and points every node at an old version.")
+			versions, err := client.FileVersionIds(bob, bobFile)
+			Expect(err).To(BeNil())
+			Expect(versions).To(HaveLen(1))
+			err = client.ForgeFileNodes(bob, bobFile, func(fileNode *client.FileNode) {
+				fileNode.Parent = uuid.Nil
+				fileNode.FileHead = versions[0]
+			})
+			Expect(err).To(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo)))
+
+			userlib.DebugMsg("Revoking charles still only gives alice the new write key.")
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).To(Equal(client.ErrReadOnly))
+			_, err = bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(Equal(client.ErrReadOnly))
+			err = alice.AppendToFile(aliceFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentTwo + contentThree)))
+			tree, err := alice.GetShareTree(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(tree.Children).To(Equal([]client.ShareNode{{Username: "bob", Access: client.AccessRead}}))
+		})
+
+		Specify("Folders can't be shared read-only", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("team")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitationWithAccess("team", "bob", client.AccessRead)
+			Expect(err).ToNot(BeNil())
+			_, err = alice.CreateInvitation("team", "bob")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitationWithAccess("team", "bob", client.AccessRead)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Writer keys registered by anyone but the owner are rejected", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob signs Alice's file with a writer key of his own.")
+			err = client.ClaimWriterKey(bob, bobFile)
+			Expect(err).To(BeNil())
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+			err = alice.AppendToFile(aliceFile, []byte(contentTwo))
+			Expect(err).ToNot(BeNil())
+			Expect(err).ToNot(Equal(client.ErrReadOnly))
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Public-key entries stored before keys were wrapped can still be read", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+
+			err = client.StoreLegacyFileKey(alice, aliceFile, "bob", bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+	})
+
+	Describe("Append-Only Share Tests", func() {
+
+		Specify("Contributions reach the file once the owner loads it", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, "reports.txt")
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob can append but not read or overwrite.")
+			err = bob.AppendToFile("reports.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			bobPhone, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			err = bobPhone.AppendToFile("reports.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+			_, err = bob.LoadFile("reports.txt")
+			Expect(err).To(Equal(client.ErrAppendOnly))
+			err = bob.StoreFile("reports.txt", []byte(contentThree))
+			Expect(err).To(Equal(client.ErrAppendOnly))
+			_, err = bob.CreateInvitation("reports.txt", "charles")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Nothing shows up until alice loads the file.")
+			data, err := charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			info, err := alice.Stat(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(info.LastWriter).To(Equal("bob"))
+
+			userlib.DebugMsg("Later appends carry on after the collected ones.")
+			err = bob.AppendToFile("reports.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree + contentOne)))
+		})
+
+		Specify("Only the owner hands out drop boxes, and revoking one keeps what was dropped", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			_, err = charles.CreateInvitationWithAccess(charlesFile, "bob", client.AccessAppend)
+			Expect(err).ToNot(BeNil())
+			err = alice.Mkdir("team")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitationWithAccess("team", "bob", client.AccessAppend)
+			Expect(err).ToNot(BeNil())
+
+			invite, err = alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Revoking bob didn't re-key the file for charles.")
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+
+			userlib.DebugMsg("Deleting the drop box only removes bob's name for it.")
+			err = bob.DeleteFile(bobFile)
+			Expect(err).To(BeNil())
+			err = bob.StoreFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			data, err = bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentThree)))
+		})
+
+		Specify("Tampered contributions close their drop box without failing the owner's load", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitationWithAccess(aliceFile, "doris", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, "dorisFile.txt")
+			Expect(err).To(BeNil())
+
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			for key, value := range userlib.DatastoreGetMap() {
+				if _, ok := before[key]; !ok {
+					tampered := append([]byte{}, value...)
+					tampered[len(tampered)-1] ^= 1
+					userlib.DatastoreSet(key, tampered)
+				}
+			}
+			err = doris.AppendToFile("dorisFile.txt", []byte(contentOne))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Alice keeps what bob dropped before the tampered contribution and all of doris'.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentOne)))
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).ToNot(BeNil())
+			err = doris.AppendToFile("dorisFile.txt", []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentOne + contentTwo)))
+		})
+
+		Specify("Revoking a drop box closes it even if what's in it can't be collected", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			stored := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				if _, ok := before[key]; !ok {
+					stored[key] = value
+				}
+			}
+			invite, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Everything alice stored for her file is tampered with, so nothing can be collected.")
+			for key, value := range stored {
+				tampered := append([]byte{}, value...)
+				tampered[len(tampered)-1] ^= 1
+				userlib.DatastoreSet(key, tampered)
+			}
+			_, err = alice.LoadFile(aliceFile)
+			Expect(err).ToNot(BeNil())
+
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentThree))
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Expiry Tests", func() {
+
+		Specify("Expired invitations can't be accepted", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateExpiringInvitation(aliceFile, "bob", client.AccessWrite, time.Now().Add(-time.Second), time.Time{})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+			invite, err = alice.CreateExpiringInvitation(aliceFile, "bob", client.AccessAppend, time.Now().Add(-time.Second), time.Time{})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			invite, err = alice.CreateExpiringInvitation(aliceFile, "bob", client.AccessRead, time.Now().Add(time.Hour), time.Time{})
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(bobFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+		})
+
+		Specify("The owner's client revokes access once it runs out", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			until := time.Now().Add(100 * time.Millisecond)
+			invite, err := alice.CreateExpiringInvitation(aliceFile, "bob", client.AccessWrite, time.Time{}, until)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateExpiringInvitation(aliceFile, "doris", client.AccessAppend, time.Time{}, until)
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, "dorisFile.txt")
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Only the owner can give access that expires.")
+			_, err = bob.CreateExpiringInvitation(bobFile, "doris", client.AccessWrite, time.Time{}, until)
+			Expect(err).ToNot(BeNil())
+
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = doris.AppendToFile("dorisFile.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+			time.Sleep(200 * time.Millisecond)
+
+			userlib.DebugMsg("Alice's next load revokes bob and closes doris' drop box after collecting it.")
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			_, err = bob.LoadFile(bobFile)
+			Expect(err).ToNot(BeNil())
+			err = doris.AppendToFile("dorisFile.txt", []byte(contentOne))
+			Expect(err).ToNot(BeNil())
+			data, err = charles.LoadFile(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo + contentThree)))
+		})
+
+	})
+
+	Describe("Cancel Invitation Tests", func() {
+
+		Specify("Cancelled invitations can't be accepted and nothing is re-keyed", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			content := strings.Repeat("x", 8*client.ChunkSize)
+			err = alice.StoreFile(aliceFile, []byte(content))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+
+			userlib.DatastoreResetBandwidth()
+			err = alice.CancelInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", client.ChunkSize))
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+			err = alice.CancelInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Charles' access is untouched, and accepted invitations can't be cancelled.")
+			err = charles.AppendToFile(charlesFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.CancelInvitation(aliceFile, "charles")
+			Expect(err).ToNot(BeNil())
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(content + contentOne)))
+
+			userlib.DebugMsg("Bob can still be invited again.")
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Inviting a pending recipient again cancels their first invitation", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			first, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			second, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessRead)
+			Expect(err).To(BeNil())
+			tree, err := alice.GetShareTree(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(tree.Children).To(Equal([]client.ShareNode{{Username: "bob", Pending: true}}))
+			entries, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Invitation).To(Equal(second))
+
+			err = bob.AcceptInvitation("alice", first, bobFile)
+			Expect(err).ToNot(BeNil())
+			err = bob.AcceptInvitation("alice", second, bobFile)
+			Expect(err).To(BeNil())
+			tree, err = alice.GetShareTree(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(tree.Children).To(Equal([]client.ShareNode{{Username: "bob", Access: client.AccessRead}}))
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(Equal(client.ErrReadOnly))
+		})
+
+		Specify("Pending drop boxes and revoked invitations can't be accepted either", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = alice.CancelInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).ToNot(BeNil())
+			err = alice.CancelInvitation(aliceFile, "charles")
+			Expect(err).ToNot(BeNil())
+		})
+
+	})
+
+	Describe("Inbox Tests", func() {
+
+		Specify("Invitations show up in the recipient's inbox until they're dealt with", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.Mkdir("docs")
+			Expect(err).To(BeNil())
+			err = alice.StoreFile("docs/"+aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = charles.StoreFile(charlesFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(testFile, []byte(contentThree))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation("docs/"+aliceFile, "bob")
+			Expect(err).To(BeNil())
+			_, err = charles.CreateInvitationWithAccess(charlesFile, "bob", client.AccessRead)
+			Expect(err).To(BeNil())
+			_, err = alice.CreateExpiringInvitation(testFile, "bob", client.AccessWrite, time.Now().Add(-time.Second), time.Time{})
+			Expect(err).To(BeNil())
+
+			userlib.DebugMsg("Bob finds them from a new session, without being told the UUIDs.")
+			bobLaptop, err := client.GetUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			entries, err := bobLaptop.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0].Sender).To(Equal("alice"))
+			Expect(entries[0].Filename).To(Equal(aliceFile))
+			Expect(entries[1].Sender).To(Equal("charles"))
+			Expect(entries[1].Filename).To(Equal(charlesFile))
+			Expect(entries[0].Sent.After(entries[1].Sent)).To(BeFalse())
+
+			err = bobLaptop.AcceptInvitation(entries[0].Sender, entries[0].Invitation, entries[0].Filename)
+			Expect(err).To(BeNil())
+			data, err := bob.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Sender).To(Equal("charles"))
+
+			userlib.DebugMsg("Cancelled invitations drop out and new ones still arrive.")
+			err = charles.CancelInvitation(charlesFile, "bob")
+			Expect(err).To(BeNil())
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+			_, err = alice.CreateInvitation(testFile, "bob")
+			Expect(err).To(BeNil())
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Filename).To(Equal(testFile))
+		})
+
+		Specify("Forged inbox hints don't hide new invitations", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			err = alice.StoreFile(testFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			entries, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+
+			userlib.DebugMsg("Someone points bob's hint far past his last slot.")
+			hint, ok := userlib.DatastoreGet(client.InboxHintId("bob"))
+			Expect(ok).To(BeTrue())
+			userlib.DatastoreSet(client.InboxHintId("bob"), []byte("1000"))
+			_, err = alice.CreateInvitation(testFile, "bob")
+			Expect(err).To(BeNil())
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Filename).To(Equal(testFile))
+
+			userlib.DebugMsg("Changing the number in a hint bob signed doesn't work either.")
+			tampered := append([]byte{}, hint...)
+			tampered[len(tampered)-1] += 5
+			userlib.DatastoreSet(client.InboxHintId("bob"), tampered)
+			err = alice.StoreFile("third.txt", []byte(contentThree))
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitation("third.txt", "bob")
+			Expect(err).To(BeNil())
+			entries, err = bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[1].Filename).To(Equal("third.txt"))
+		})
+
+		Specify("Tampered inbox entries are skipped", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			before := make(map[userlib.UUID][]byte)
+			for key, value := range userlib.DatastoreGetMap() {
+				before[key] = value
+			}
+			_, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			for key, value := range userlib.DatastoreGetMap() {
+				if _, ok := before[key]; !ok {
+					tampered := append([]byte{}, value...)
+					tampered[len(tampered)-1] ^= 1
+					userlib.DatastoreSet(key, tampered)
+				}
+			}
+			entries, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+		})
+
+	})
+
+	Describe("Decline Invitation Tests", func() {
+
+		Specify("Declined invitations are deleted and the sender stops listing the recipient", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			content := strings.Repeat("x", 8*client.ChunkSize)
+			err = alice.StoreFile(aliceFile, []byte(content))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateExpiringInvitation(aliceFile, "bob", client.AccessWrite, time.Time{}, time.Now().Add(50*time.Millisecond))
+			Expect(err).To(BeNil())
+
+			userlib.DatastoreResetBandwidth()
+			err = bob.DeclineInvitation("alice", invite)
+			Expect(err).To(BeNil())
+			Expect(userlib.DatastoreGetBandwidth()).To(BeNumerically("<", client.ChunkSize))
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+			entries, err := bob.ListInvitations()
+			Expect(err).To(BeNil())
+			Expect(entries).To(BeEmpty())
+			err = alice.CancelInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+			err = alice.RevokeAccess(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("The grant that would have expired doesn't get in the owner's way.")
+			time.Sleep(100 * time.Millisecond)
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(content)))
+
+			userlib.DebugMsg("Bob can still be invited again, and only his sender can be named.")
+			invite, err = alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.DeclineInvitation("charles", invite)
+			Expect(err).ToNot(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+		})
+
+		Specify("Declined drop boxes are closed by the owner", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = bob.DeclineInvitation("alice", invite)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).ToNot(BeNil())
+
+			data, err := alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne)))
+			err = alice.CancelInvitation(aliceFile, "bob")
+			Expect(err).ToNot(BeNil())
+
+			userlib.DebugMsg("Alice can give Bob a new drop box.")
+			invite, err = alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			err = bob.AppendToFile(bobFile, []byte(contentTwo))
+			Expect(err).To(BeNil())
+			data, err = alice.LoadFile(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(data).To(Equal([]byte(contentOne + contentTwo)))
+		})
+
+	})
+
+	Describe("Share Tree Tests", func() {
+
+		Specify("Owners see the whole tree and recipients their own subtree", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitation(aliceFile, "bob")
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			charlesInvite, err := bob.CreateInvitation(bobFile, "charles")
+			Expect(err).To(BeNil())
+			_, err = alice.CreateInvitationWithAccess(aliceFile, "doris", client.AccessAppend)
+			Expect(err).To(BeNil())
+
+			tree, err := alice.GetShareTree(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(tree).To(Equal(client.ShareNode{
+				Username: "alice",
+				Access:   client.AccessWrite,
+				Children: []client.ShareNode{
+					{Username: "bob", Access: client.AccessWrite, Children: []client.ShareNode{
+						{Username: "charles", Pending: true},
+					}},
+					{Username: "doris", Access: client.AccessAppend, Pending: true},
+				},
+			}))
+
+			userlib.DebugMsg("Bob only sees who he invited, and sees them accept.")
+			err = charles.AcceptInvitation("bob", charlesInvite, charlesFile)
+			Expect(err).To(BeNil())
+			tree, err = bob.GetShareTree(bobFile)
+			Expect(err).To(BeNil())
+			Expect(tree).To(Equal(client.ShareNode{
+				Username: "bob",
+				Access:   client.AccessWrite,
+				Children: []client.ShareNode{{Username: "charles", Access: client.AccessWrite}},
+			}))
+			tree, err = charles.GetShareTree(charlesFile)
+			Expect(err).To(BeNil())
+			Expect(tree.Username).To(Equal("charles"))
+			Expect(tree.Children).To(BeEmpty())
+			_, err = charles.GetShareTree(aliceFile)
+			Expect(err).ToNot(BeNil())
+		})
+
+		Specify("Share trees show access and drop revoked recipients", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitationWithAccess(aliceFile, "doris", client.AccessAppend)
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("alice", invite, testFile)
+			Expect(err).To(BeNil())
+
+			err = alice.RevokeAccess(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			tree, err := alice.GetShareTree(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(tree.Children).To(Equal([]client.ShareNode{
+				{Username: "bob", Access: client.AccessRead},
+				{Username: "doris", Access: client.AccessAppend},
+			}))
+
+			tree, err = bob.GetShareTree(bobFile)
+			Expect(err).To(BeNil())
+			Expect(tree).To(Equal(client.ShareNode{Username: "bob", Access: client.AccessRead}))
+			tree, err = doris.GetShareTree(testFile)
+			Expect(err).To(BeNil())
+			Expect(tree).To(Equal(client.ShareNode{Username: "doris", Access: client.AccessAppend}))
+		})
+
+		Specify("Readers who rewrite the file's nodes are still shown with read access", func() {
+			alice, err = client.InitUser("alice", defaultPassword)
+			Expect(err).To(BeNil())
+			bob, err = client.InitUser("bob", defaultPassword)
+			Expect(err).To(BeNil())
+			charles, err = client.InitUser("charles", defaultPassword)
+			Expect(err).To(BeNil())
+			doris, err = client.InitUser("doris", defaultPassword)
+			Expect(err).To(BeNil())
+
+			err = alice.StoreFile(aliceFile, []byte(contentOne))
+			Expect(err).To(BeNil())
+			invite, err := alice.CreateInvitationWithAccess(aliceFile, "bob", client.AccessRead)
+			Expect(err).To(BeNil())
+			err = bob.AcceptInvitation("alice", invite, bobFile)
+			Expect(err).To(BeNil())
+			invite, err = alice.CreateInvitation(aliceFile, "charles")
+			Expect(err).To(BeNil())
+			err = charles.AcceptInvitation("alice", invite, charlesFile)
+			Expect(err).To(BeNil())
+			invite, err = bob.CreateInvitationWithAccess(bobFile, "doris", client.AccessRead)
+			Expect(err).To(BeNil())
+			err = doris.AcceptInvitation("bob", invite, "dorisFile.txt")
+			Expect(err).To(BeNil())
+
+			err = client.ForgeFileNodes(doris, "dorisFile.txt", func(fileNode *client.FileNode) {
+				fileNode.Parent = uuid.Nil
+				fileNode.FileHead = uuid.Nil
+			})
+			Expect(err).To(BeNil())
+			tree, err := alice.GetShareTree(aliceFile)
+			Expect(err).To(BeNil())
+			Expect(tree.Children).To(Equal([]client.ShareNode{
+				{Username: "bob", Access: client.AccessRead, Children: []client.ShareNode{
+					{Username: "doris", Access: client.AccessRead},
+				}},
+				{Username: "charles", Access: client.AccessWrite},
+			}))
+			tree, err = doris.GetShareTree("dorisFile.txt")
+			Expect(err).To(BeNil())
+			Expect(tree).To(Equal(client.ShareNode{Username: "doris", Access: client.AccessRead}))
+		})
+
+	})
+
 	Describe("Tampering Tests", func() {
 
 		Specify("Tamper with user and file structs sneakily", func() {
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"encoding/json"
+
+	userlib "github.com/cs161-staff/project2-userlib"
+	"github.com/google/uuid"
+)
+
+// Rewrite a file's FileNodes, from the user's own up through everyone who invited them, as
+// anyone holding its file key could
+func ForgeFileNodes(user *User, filename string, edit func(fileNode *FileNode)) (err error) {
+	fileKey, fileMacKey, err := getFileKeys(user, filename)
+	if err != nil {
+		return err
+	}
+	fileNodeId, err := getFileNodeId(user, filename)
+	if err != nil {
+		return err
+	}
+	for fileNodeId != uuid.Nil {
+		fileNode, err := getFileNode(fileKey, fileMacKey, fileNodeId)
+		if err != nil {
+			return err
+		}
+		parent := fileNode.Parent
+		edit(&fileNode)
+		err = symEncThenTag(fileKey, fileMacKey, fileNode, fileNodeId)
+		if err != nil {
+			return err
+		}
+		fileNodeId = parent
+	}
+	return nil
+}
+
+// UUIDs of a file's versions, which are signed just like its head
+func FileVersionIds(user *User, filename string) (versionIds []uuid.UUID, err error) {
+	fileNodeId, fileKey, fileMacKey, writeKey, err := lookupFile(user, filename)
+	if err != nil {
+		return versionIds, err
+	}
+	fileHead, _, err := getFileHead(fileKey, fileMacKey, writeKey, fileNodeId)
+	if err != nil {
+		return versionIds, err
+	}
+	return fileHead.Versions, nil
+}
+
+// UUID of the hint senders read to find a user's first inbox slot
+func InboxHintId(username string) uuid.UUID {
+	return getUUID("inbox-hint", username)
+}
+
+// Usage as last charged to the user's signed record, without recounting it
+func ChargedUsage(user *User) (usage Usage, err error) {
+	usage, _, err = getUsage(user.Username, user.usageKey)
+	return usage, err
+}
+
+// Run a batch's commit up to its commit point, and through it if committed, then stop as a
+// client that went away would
+func StopCommit(batch *Batch, committed bool) (err error) {
+	batch.committed = true
+	err = batch.prepare()
+	if err != nil {
+		return err
+	}
+	if committed {
+		userlib.DatastoreSet(batch.id, batch.token)
+	}
+	return nil
+}
+
+// Store a recipient's file key the way owners did before public-key entries wrapped a
+// symmetric key, as a single PKE block signed by the owner
+func StoreLegacyFileKey(owner *User, filename string, recipientUsername string, recipientFilename string) (err error) {
+	fileKey, _, err := getFileKeys(owner, filename)
+	if err != nil {
+		return err
+	}
+	encKey, _ := userlib.KeystoreGet(getUUID("pke", recipientUsername).String())
+	marshalKey, err := json.Marshal(fileKey)
+	if err != nil {
+		return err
+	}
+	encContent, err := userlib.PKEEnc(encKey, marshalKey)
+	if err != nil {
+		return err
+	}
+	sig, err := userlib.DSSign(owner.DSSignKey, encContent)
+	if err != nil {
+		return err
+	}
+	userlib.DatastoreSet(getUUID(recipientFilename+"key", recipientUsername), append(sig, encContent...))
+	return nil
+}
+
+// Register the user's own writer key for a file that isn't signed, as anyone holding its
+// file key could, and re-sign its writer record, head, index and content nodes with it
+func ClaimWriterKey(user *User, filename string) (err error) {
+	fileNodeId, fileKey, fileMacKey, _, err := lookupFile(user, filename)
+	if err != nil {
+		return err
+	}
+	fileHead, fileHeadId, err := getFileHead(fileKey, fileMacKey, nil, fileNodeId)
+	if err != nil {
+		return err
+	}
+	nodes := make(map[uuid.UUID]ContentNode)
+	for id := fileHead.FirstNode; id != uuid.Nil; id = nodes[id].NextNode {
+		nodes[id], err = getContentNode(fileKey, fileMacKey, id)
+		if err != nil {
+			return err
+		}
+	}
+	pages := make(map[uuid.UUID][]byte)
+	for _, id := range fileHead.IndexPages {
+		pages[id], err = symVerifyThenDec(fileKey, fileMacKey, id)
+		if err != nil {
+			return err
+		}
+	}
+
+	writeKey, err := setupSigning(user, fileKey)
+	if err != nil {
+		return err
+	}
+	err = putWriters(fileKey, fileMacKey, writeKey, FileWriters{Head: fileHeadId})
+	if err != nil {
+		return err
+	}
+	err = fileEncThenTag(fileKey, fileMacKey, writeKey, fileHead, fileHeadId)
+	if err != nil {
+		return err
+	}
+	for id, node := range nodes {
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, node, id)
+		if err != nil {
+			return err
+		}
+	}
+	for id, page := range pages {
+		var indexPage IndexPage
+		err = json.Unmarshal(page, &indexPage)
+		if err != nil {
+			return err
+		}
+		err = fileEncThenTag(fileKey, fileMacKey, writeKey, indexPage, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}